@@ -36,7 +36,7 @@ func (alert *Alert) Ring(msg *AlertMessage) {
 	varMap["UNIQUEID"] = msg.UniqueID
 	varMap["HOST_NAME"] = msg.Hostname
 	varMap["CLASSES"] = strings.Join(msg.Classes, ",")
-	varMap["NOSEE_SRV"] = GlobalConfig.Name
+	varMap["NOSEE_SRV"] = GlobalConfigGet().Name
 	varMap["DATETIME"] = msg.DateTime.Format(time.RFC3339)
 	// "Level" ? (Run, Task, Checks)
 	// Probe Name, Check Name, Alert Name ?
@@ -47,7 +47,9 @@ func (alert *Alert) Ring(msg *AlertMessage) {
 		args = append(args, expArg)
 	}
 
+	backgroundJobs.Add(1)
 	go func() {
+		defer backgroundJobs.Done()
 		cmd := exec.Command(alert.Command, args...)
 
 		env := os.Environ()
@@ -36,6 +36,13 @@ type AlertMessage struct {
 // GeneralClass is a "general" class for very important general messages
 const GeneralClass = "general"
 
+// Severity classes, as used by checks (see etc/probes.d), for alerts
+// created by Nosee itself
+const (
+	WarningClass  = "warning"
+	CriticalClass = "critical"
+)
+
 func (amt AlertMessageType) String() string {
 	if amt == 0 {
 		return "INVALID_TYPE"
@@ -59,6 +66,10 @@ func AlertMessageCreateForRun(aType AlertMessageType, run *Run, currentFail *Cur
 	switch aType {
 	case AlertBad:
 		details.WriteString("A least one error occured during a run for this host. (" + run.StartTime.Format("2006-01-02 15:04:05") + ")\n")
+		writeRunAddress(&details, run)
+		if run.DialTimings != (SSHDialTimings{}) {
+			details.WriteString("Connection timings: " + run.DialTimings.String() + "\n")
+		}
 		details.WriteString("\n")
 		details.WriteString("Error(s):\n")
 		for _, err := range run.Errors {
@@ -77,6 +88,102 @@ func AlertMessageCreateForRun(aType AlertMessageType, run *Run, currentFail *Cur
 	return &message
 }
 
+// AlertMessageCreateForDial creates an AlertGood or AlertBad message
+// for slow SSH connections of a host
+func AlertMessageCreateForDial(aType AlertMessageType, run *Run, currentFail *CurrentFail) *AlertMessage {
+	var message AlertMessage
+
+	conn := run.Host.Connection
+
+	message.UniqueID = currentFail.UniqueID
+	message.Type = aType
+	message.Hostname = run.Host.Name
+	message.DateTime = run.StartTime
+
+	var details bytes.Buffer
+
+	switch aType {
+	case AlertBad:
+		message.Subject = fmt.Sprintf("[%s] %s: slow SSH connection (%s)", aType, run.Host.Name, run.DialDuration.Round(time.Millisecond))
+		details.WriteString(fmt.Sprintf("SSH connection time was too long for %d run(s). (", currentFail.FailCount) + run.StartTime.Format("2006-01-02 15:04:05") + ")\n")
+		details.WriteString("Probes are still running normally.\n")
+		details.WriteString("\n")
+		details.WriteString("Failure time: " + currentFail.FailStart.Format("2006-01-02 15:04:05") + "\n")
+	case AlertGood:
+		message.Subject = fmt.Sprintf("[%s] %s: SSH connection time is OK", aType, run.Host.Name)
+		details.WriteString("SSH connection time is normal again. (" + run.StartTime.Format("2006-01-02 15:04:05") + ")\n")
+		details.WriteString("\n")
+	}
+
+	details.WriteString(fmt.Sprintf("Connection time: %s (ssh_connection_time_warn = %s)\n", run.DialDuration, conn.SSHConnTimeWarn))
+	details.WriteString("Connection timings: " + run.DialTimings.String() + "\n")
+	writeRunAddress(&details, run)
+
+	details.WriteString("\n")
+	details.WriteString("Unique failure ID: " + message.UniqueID + "\n")
+	message.Details = details.String()
+
+	message.Classes = []string{WarningClass}
+
+	return &message
+}
+
+// AlertMessageCreateForConnection creates an AlertGood or AlertBad
+// 'general' message about connections to a host, outside of any Run: the
+// text (with the date) is followed by details, if any
+func AlertMessageCreateForConnection(aType AlertMessageType, hostname string, subject string, text string, details string, uniqueID string) *AlertMessage {
+	var message AlertMessage
+
+	message.Subject = fmt.Sprintf("[%s] %s: %s", aType, hostname, subject)
+	message.Type = aType
+	message.UniqueID = uniqueID
+	message.Hostname = hostname
+	message.DateTime = time.Now()
+
+	var buf bytes.Buffer
+
+	buf.WriteString(text + " (" + message.DateTime.Format("2006-01-02 15:04:05") + ")\n")
+	buf.WriteString(details)
+
+	buf.WriteString("\n")
+	buf.WriteString("Unique failure ID: " + message.UniqueID + "\n")
+	message.Details = buf.String()
+
+	message.Classes = []string{GeneralClass}
+
+	return &message
+}
+
+// AlertMessageCreateForUnreachable creates an AlertBad message for a Run
+// that failed while a parent of the host is down
+func AlertMessageCreateForUnreachable(run *Run, parent string, currentFail *CurrentFail) *AlertMessage {
+	var message AlertMessage
+
+	message.Subject = fmt.Sprintf("[%s] %s: unreachable because parent %s is down", AlertBad, run.Host.Name, parent)
+	message.Type = AlertBad
+	message.UniqueID = currentFail.UniqueID
+	message.Hostname = run.Host.Name
+	message.DateTime = run.StartTime
+
+	var details bytes.Buffer
+
+	details.WriteString("This host is unreachable, probably because its parent '" + parent + "' is down. (" + run.StartTime.Format("2006-01-02 15:04:05") + ")\n")
+	details.WriteString("Alerts for this host are held back until the parent is up again.\n")
+	details.WriteString("\n")
+	details.WriteString("Error(s):\n")
+	for _, err := range run.Errors {
+		details.WriteString(err.Error() + "\n")
+	}
+
+	details.WriteString("\n")
+	details.WriteString("Unique failure ID: " + message.UniqueID + "\n")
+	message.Details = details.String()
+
+	message.Classes = []string{GeneralClass}
+
+	return &message
+}
+
 // AlertMessageCreateForTaskResult creates an AlertGood or AlertBad message for a TaskResult
 func AlertMessageCreateForTaskResult(aType AlertMessageType, run *Run, taskResult *TaskResult, currentFail *CurrentFail) *AlertMessage {
 	var message AlertMessage
@@ -92,6 +199,7 @@ func AlertMessageCreateForTaskResult(aType AlertMessageType, run *Run, taskResul
 	switch aType {
 	case AlertBad:
 		details.WriteString("A least one error occured during a task for this host. (" + taskResult.StartTime.Format("2006-01-02 15:04:05") + ")\n")
+		writeRunAddress(&details, run)
 		details.WriteString("\n")
 		details.WriteString("Error(s):\n")
 		for _, err := range taskResult.Errors {
@@ -118,11 +226,12 @@ func AlertMessageCreateForTaskResult(aType AlertMessageType, run *Run, taskResul
 }
 
 // AlertMessageCreateForCheck creates a AlertGood or AlertBad message for a Check
-func AlertMessageCreateForCheck(aType AlertMessageType, run *Run, taskRes *TaskResult, check *Check, currentFail *CurrentFail) *AlertMessage {
+func AlertMessageCreateForCheck(aType AlertMessageType, run *Run, taskRes *TaskResult, checkRes *CheckResult, currentFail *CurrentFail) *AlertMessage {
 	var message AlertMessage
+	check := checkRes.Check
 
-	// Host: Check (Task)
-	message.Subject = fmt.Sprintf("[%s] %s: %s (%s)", aType, run.Host.Name, check.Desc, taskRes.Task.Probe.Name)
+	// Host: Check (Instance) (Task)
+	message.Subject = fmt.Sprintf("[%s] %s: %s (%s)", aType, run.Host.Name, checkRes.Desc(), taskRes.Task.Probe.Name)
 	message.Type = aType
 	message.UniqueID = currentFail.UniqueID
 	message.Hostname = run.Host.Name
@@ -141,12 +250,20 @@ func AlertMessageCreateForCheck(aType AlertMessageType, run *Run, taskRes *TaskR
 	details.WriteString("Failure time: " + currentFail.FailStart.Format("2006-01-02 15:04:05") + "\n")
 	details.WriteString("Last task time: " + taskRes.StartTime.Format("2006-01-02 15:04:05") + "\n")
 	details.WriteString("Class(es): " + strings.Join(check.Classes, ", ") + "\n")
+	if checkRes.Label != "" {
+		if _, reported := taskRes.LabelledValues[checkRes.Label]; reported == false {
+			details.WriteString("Instance: " + checkRes.Label + " (no longer reported)\n")
+		} else {
+			details.WriteString("Instance: " + checkRes.Label + "\n")
+		}
+	}
+	writeRunAddress(&details, run)
 	details.WriteString("Failed condition was: " + check.If.String() + "\n")
 	details.WriteString("\n")
 	details.WriteString("Values:\n")
 	for _, token := range check.If.Vars() {
 		if IsAllUpper(token) {
-			details.WriteString("- " + token + ": " + taskRes.Values[token] + "\n")
+			details.WriteString("- " + token + ": " + taskRes.Value(token, checkRes.Label) + "\n")
 		} else {
 			val := InterfaceValueToString(taskRes.Task.Probe.Defaults[token])
 			if _, exists := taskRes.Host.Defaults[token]; exists == true {
@@ -159,7 +276,7 @@ func AlertMessageCreateForCheck(aType AlertMessageType, run *Run, taskRes *TaskR
 	details.WriteString(fmt.Sprintf("All values for this run (%s):\n", run.Duration))
 	for _, tr := range run.TaskResults {
 		details.WriteString(fmt.Sprintf("- %s (%s):\n", tr.Task.Probe.Name, tr.Duration))
-		for key, val := range tr.Values {
+		for key, val := range tr.AllValues() {
 			details.WriteString("--- " + key + ": " + val + "\n")
 		}
 	}
@@ -172,6 +289,13 @@ func AlertMessageCreateForCheck(aType AlertMessageType, run *Run, taskRes *TaskR
 	return &message
 }
 
+// writeRunAddress adds the address that answered for the run, if any
+func writeRunAddress(details *bytes.Buffer, run *Run) {
+	if run.Address != "" {
+		details.WriteString("Address: " + run.Address + "\n")
+	}
+}
+
 // Dump prints AlertMessage informations on the screen for debugging purposes
 func (msg *AlertMessage) Dump() {
 	fmt.Printf("---\n")
@@ -182,7 +306,7 @@ func (msg *AlertMessage) Dump() {
 // RingAlerts will search and ring all alerts for this AlertMessage
 func (msg *AlertMessage) RingAlerts() {
 	ringCount := 0
-	for _, alert := range globalAlerts {
+	for _, alert := range globalAlertsGet() {
 		if msg.MatchAlertTargets(alert) {
 			if alert.Ringable() {
 				alert.Ring(msg)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"time"
 
@@ -60,5 +61,76 @@ func CheckFunctionsInit() {
 
 			return nil, fmt.Errorf("date function: invalid format '%s'", format)
 		},
+
+		// length of an array, object or string (JSON output)
+		"len": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("len function: wrong argument count (1 required)")
+			}
+			switch v := args[0].(type) {
+			case jsonArray:
+				return (float64)(len(v)), nil
+			case map[string]interface{}:
+				return (float64)(len(v)), nil
+			case string:
+				return (float64)(len(v)), nil
+			}
+			return nil, fmt.Errorf("len function: invalid argument type '%T'", args[0])
+		},
+
+		// get(VALUE, "key", 0, …): nested value of an array or object
+		// (JSON output), keys are object names or array indexes
+		"get": func(args ...interface{}) (interface{}, error) {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("get function: wrong argument count (2 or more required)")
+			}
+			val := args[0]
+			path := "$"
+			for _, key := range args[1:] {
+				switch v := val.(type) {
+				case map[string]interface{}:
+					name, ok := key.(string)
+					if ok == false {
+						return nil, fmt.Errorf("get function: %s is an object, key must be a string (got %v)", path, key)
+					}
+					path = jsonPathKey(path, name)
+					if val, ok = v[name]; ok == false {
+						return nil, fmt.Errorf("get function: no value at %s", path)
+					}
+				case jsonArray:
+					num, ok := key.(float64)
+					if ok == false || num != float64(int(num)) {
+						return nil, fmt.Errorf("get function: %s is an array, key must be an index (got %v)", path, key)
+					}
+					path = jsonPathIndex(path, int(num))
+					if int(num) < 0 || int(num) >= len(v) {
+						return nil, fmt.Errorf("get function: no value at %s (%d item(s))", path, len(v))
+					}
+					val = v[int(num)]
+				default:
+					return nil, fmt.Errorf("get function: %s is not an array or an object", path)
+				}
+			}
+			return val, nil
+		},
+
+		// contains(ARRAY, value): true if the array (JSON output) has
+		// this value
+		"contains": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("contains function: wrong argument count (2 required)")
+			}
+			list, ok := args[0].(jsonArray)
+			if ok == false {
+				return nil, fmt.Errorf("contains function: first argument must be an array (got '%T')", args[0])
+			}
+			for _, item := range list {
+				// arrays and objects can't be compared with ==
+				if reflect.DeepEqual(item, args[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+func TestCheckFunctionsJSON(t *testing.T) {
+	result := &TaskResult{
+		Host:       &Host{Name: "h"},
+		Values:     make(map[string]string),
+		Structured: make(map[string]interface{}),
+	}
+	result.parseJSONOutput([]byte(`{
+		"DISKS": [{"mount": "/", "perc": 91}, {"mount": "/var", "perc": 12}],
+		"PROCS": ["sshd", "cron"],
+		"NUMS": [1, 2.5],
+		"PAIRS": [[1, 2], {"a": 1}],
+		"SERVICE": {"name": "httpd", "ports": [80, 443]},
+		"EMPTY": []
+	}`))
+	if len(result.Errors) > 0 {
+		t.Fatalf("errors: %q", result.Errors)
+	}
+	params := map[string]interface{}{"NAME": "httpd"}
+	for key, val := range result.Structured {
+		params[key] = val
+	}
+
+	tests := []struct {
+		expr string
+		want interface{}
+		err  string // contained by the error, if any
+	}{
+		{"len(DISKS)", 2.0, ""},
+		{"len(EMPTY)", 0.0, ""},
+		{"len(SERVICE)", 2.0, ""},
+		{"len(NAME)", 5.0, ""},
+		{"len(1)", nil, "len function: invalid argument type 'float64'"},
+		{"get(DISKS, 0, 'perc')", 91.0, ""},
+		{"get(DISKS, 1, 'mount')", "/var", ""},
+		{"get(SERVICE, 'ports', 1)", 443.0, ""},
+		{"get(DISKS, 0, 'perc') > 90", true, ""},
+		{"get(DISKS, 2, 'perc')", nil, "get function: no value at $[2] (2 item(s))"},
+		{"get(DISKS, -1)", nil, "get function: no value at $[-1]"},
+		{"get(DISKS, 0.5)", nil, "get function: $ is an array, key must be an index (got 0.5)"},
+		{"get(DISKS, 'perc')", nil, "get function: $ is an array, key must be an index (got perc)"},
+		{"get(DISKS, 0, 'size')", nil, "get function: no value at $[0].size"},
+		{"get(DISKS, 0, 0)", nil, "get function: $[0] is an object, key must be a string (got 0)"},
+		{"get(DISKS, 0, 'perc', 0)", nil, "get function: $[0].perc is not an array or an object"},
+		{"get(DISKS)", nil, "get function: wrong argument count (2 or more required)"},
+		{"contains(PROCS, 'sshd')", true, ""},
+		{"contains(PROCS, 'httpd')", false, ""},
+		{"contains(PROCS, NAME) == false", true, ""},
+		{"contains(NUMS, 2.5)", true, ""},
+		{"contains(get(SERVICE, 'ports'), 443)", true, ""},
+		{"contains(PAIRS, get(PAIRS, 0))", true, ""},
+		{"contains(PAIRS, get(PAIRS, 1))", true, ""},
+		{"contains(SERVICE, 'name')", nil, "contains function: first argument must be an array (got 'map[string]interface {}')"},
+		{"contains(PROCS)", nil, "contains function: wrong argument count (2 required)"},
+	}
+
+	for _, test := range tests {
+		expr, err := govaluate.NewEvaluableExpressionWithFunctions(test.expr, CheckFunctions)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		got, err := expr.Evaluate(params)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.expr, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: no error, want '%s'", test.expr, test.err)
+		case test.err != "" && strings.Contains(err.Error(), test.err) == false:
+			t.Errorf("%s: error is '%s', want '%s'", test.expr, err, test.err)
+		case test.err == "" && reflect.DeepEqual(got, test.want) == false:
+			t.Errorf("%s = %#v, want %#v", test.expr, got, test.want)
+		}
+	}
+}
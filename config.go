@@ -5,18 +5,37 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh"
 )
 
 type tomlConfig struct {
-	Name            string
-	StartTimeSpread Duration `toml:"start_time_spread"`
-	SSHConnTimeWarn Duration `toml:"ssh_connection_time_warn"`
-	SSHBlindTrust   bool     `toml:"ssh_blindtrust_fingerprints"`
-	SavePath        string   `toml:"save_path"`
-	HeartbeatDelay  Duration `toml:"heartbeat_delay"`
+	Name               string
+	StartTimeSpread    Duration `toml:"start_time_spread"`
+	SSHConnTimeWarn    Duration `toml:"ssh_connection_time_warn"`
+	SSHConnectTimeout  Duration `toml:"ssh_connect_timeout"`
+	SSHConnTimeFails   int      `toml:"ssh_connection_time_needed_failures"`
+	RunTimeout         Duration `toml:"run_timeout"`
+	SSHPersistent      bool     `toml:"ssh_persistent"`
+	SSHKeepalive       Duration `toml:"ssh_keepalive"`
+	SSHBlindTrust      bool     `toml:"ssh_blindtrust_fingerprints"`
+	SSHHostCAFile      string   `toml:"ssh_host_ca_file"`
+	KnownHosts         string   `toml:"known_hosts"`
+	SSHTrustOnFirstUse bool     `toml:"ssh_trust_on_first_use"`
+	Ciphers            []string
+	KeyExchanges       []string `toml:"key_exchanges"`
+	MACs               []string `toml:"macs"`
+	HostKeyAlgorithms  []string `toml:"host_key_algorithms"`
+	SavePath           string   `toml:"save_path"`
+	StateMaxSize       int      `toml:"state_max_size"`
+	HeartbeatDelay     Duration `toml:"heartbeat_delay"`
+	ShutdownTimeout    Duration `toml:"shutdown_timeout"`
+
+	MaxConcurrentRuns         int            `toml:"max_concurrent_runs"`
+	MaxConcurrentRunsPerClass map[string]int `toml:"max_concurrent_runs_per_class"`
 }
 
 // Config is the final form of the nosee.toml config file
@@ -28,9 +47,23 @@ type Config struct {
 	Name                   string
 	StartTimeSpreadSeconds int
 	SSHConnTimeWarn        time.Duration
+	SSHConnectTimeout      time.Duration
+	SSHConnTimeFails       int
+	RunTimeout             time.Duration
+	SSHPersistent          bool
+	SSHKeepalive           time.Duration
 	SSHBlindTrust          bool
+	SSHHostCAs             []ssh.PublicKey
+	KnownHosts             string
+	SSHTrustOnFirstUse     bool
+	SSHAlgorithms          SSHAlgorithms
 	SavePath               string
+	StateMaxSize           int
 	HeartbeatDelay         time.Duration
+	ShutdownTimeout        time.Duration
+
+	MaxConcurrentRuns         int
+	MaxConcurrentRunsPerClass map[string]int
 }
 
 // GlobalConfig exports the Nosee server configuration
@@ -53,15 +86,47 @@ func GlobalConfigRead(dir, file string) (*Config, error) {
 	config.SSHConnTimeWarn = 10 * time.Second
 	tConfig.SSHConnTimeWarn.Duration = config.SSHConnTimeWarn
 
+	config.SSHConnTimeFails = 1
+	tConfig.SSHConnTimeFails = config.SSHConnTimeFails
+
+	config.SSHConnectTimeout = 30 * time.Second
+	tConfig.SSHConnectTimeout.Duration = config.SSHConnectTimeout
+
+	config.RunTimeout = 59 * time.Second
+	tConfig.RunTimeout.Duration = config.RunTimeout
+
+	config.SSHPersistent = false
+	tConfig.SSHPersistent = false
+
+	config.SSHKeepalive = 30 * time.Second
+	tConfig.SSHKeepalive.Duration = config.SSHKeepalive
+
 	config.SSHBlindTrust = false
 	tConfig.SSHBlindTrust = false
 
+	config.KnownHosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	tConfig.KnownHosts = config.KnownHosts
+
+	config.SSHTrustOnFirstUse = false
+	tConfig.SSHTrustOnFirstUse = false
+
 	config.SavePath = "./"
 	tConfig.SavePath = config.SavePath
 
+	config.StateMaxSize = 64 * 1024
+	tConfig.StateMaxSize = config.StateMaxSize
+
 	config.HeartbeatDelay = 30 * time.Second
 	tConfig.HeartbeatDelay.Duration = config.HeartbeatDelay
 
+	config.ShutdownTimeout = 30 * time.Second
+	tConfig.ShutdownTimeout.Duration = config.ShutdownTimeout
+
+	config.MaxConcurrentRuns = 0
+	tConfig.MaxConcurrentRuns = 0
+
+	config.MaxConcurrentRunsPerClass = make(map[string]int)
+
 	config.configPath = dir
 	config.loadDisabled = false
 	config.doConnTest = true
@@ -95,15 +160,91 @@ func GlobalConfigRead(dir, file string) (*Config, error) {
 	}
 	config.SSHConnTimeWarn = tConfig.SSHConnTimeWarn.Duration
 
+	if tConfig.SSHConnTimeFails < 1 {
+		return nil, errors.New("'ssh_connection_time_needed_failures' can't be less than 1")
+	}
+	config.SSHConnTimeFails = tConfig.SSHConnTimeFails
+
+	if tConfig.SSHConnectTimeout.Duration < (1 * time.Second) {
+		return nil, errors.New("'ssh_connect_timeout' can't be less than a second")
+	}
+	config.SSHConnectTimeout = tConfig.SSHConnectTimeout.Duration
+
+	if tConfig.RunTimeout.Duration < (1 * time.Second) {
+		return nil, errors.New("'run_timeout' can't be less than a second")
+	}
+	config.RunTimeout = tConfig.RunTimeout.Duration
+
+	config.SSHPersistent = tConfig.SSHPersistent
+
+	if tConfig.SSHKeepalive.Duration < (1 * time.Second) {
+		return nil, errors.New("'ssh_keepalive' can't be less than a second")
+	}
+	config.SSHKeepalive = tConfig.SSHKeepalive.Duration
+
 	config.SSHBlindTrust = tConfig.SSHBlindTrust
 
+	if tConfig.SSHHostCAFile != "" {
+		caFile := tConfig.SSHHostCAFile
+		if path.IsAbs(caFile) == false {
+			caFile = path.Clean(dir + "/" + caFile)
+		}
+		cas, err := ReadHostCAFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("'ssh_host_ca_file': %s", err)
+		}
+		config.SSHHostCAs = cas
+	}
+
+	if tConfig.KnownHosts == "" {
+		return nil, errors.New("'known_hosts' can't be empty")
+	}
+	config.KnownHosts = tConfig.KnownHosts
+
+	config.SSHTrustOnFirstUse = tConfig.SSHTrustOnFirstUse
+
+	config.SSHAlgorithms = SSHAlgorithms{
+		Ciphers:           tConfig.Ciphers,
+		KeyExchanges:      tConfig.KeyExchanges,
+		MACs:              tConfig.MACs,
+		HostKeyAlgorithms: tConfig.HostKeyAlgorithms,
+	}
+	if err := config.SSHAlgorithms.Check(); err != nil {
+		return nil, err
+	}
+
 	// should check if writable
 	config.SavePath = tConfig.SavePath
 
+	if tConfig.StateMaxSize < 1 || tConfig.StateMaxSize > stateMaxSizeLimit {
+		return nil, fmt.Errorf("'state_max_size' must be between 1 and %d bytes (size limit of an environment variable)", stateMaxSizeLimit)
+	}
+	config.StateMaxSize = tConfig.StateMaxSize
+
 	if tConfig.HeartbeatDelay.Duration < (5 * time.Second) {
 		return nil, errors.New("'heartbeat_delay' can't be less than 5 seconds")
 	}
 	config.HeartbeatDelay = tConfig.HeartbeatDelay.Duration
 
+	if tConfig.ShutdownTimeout.Duration < 0 {
+		return nil, errors.New("'shutdown_timeout' can't be negative")
+	}
+	config.ShutdownTimeout = tConfig.ShutdownTimeout.Duration
+
+	if tConfig.MaxConcurrentRuns < 0 {
+		return nil, errors.New("'max_concurrent_runs' can't be negative")
+	}
+	config.MaxConcurrentRuns = tConfig.MaxConcurrentRuns
+
+	for class, max := range tConfig.MaxConcurrentRunsPerClass {
+		if !IsValidTokenName(class) {
+			return nil, fmt.Errorf("'max_concurrent_runs_per_class': invalid class name '%s'", class)
+		}
+		if max < 0 {
+			return nil, fmt.Errorf("'max_concurrent_runs_per_class': limit for '%s' can't be negative", class)
+		}
+		config.MaxConcurrentRunsPerClass[class] = max
+	}
+
 	return &config, nil
 }
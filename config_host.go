@@ -10,10 +10,23 @@ import (
 )
 
 type tomlNetwork struct {
-	Host            string
-	Port            int
-	Ciphers         []string
-	SSHConnTimeWarn Duration `toml:"ssh_connection_time_warn"`
+	Transport         string
+	Command           []string
+	Host              string
+	Hosts             []string
+	HostsMode         string `toml:"hosts_mode"`
+	Port              int
+	Ciphers           []string
+	KeyExchanges      []string `toml:"key_exchanges"`
+	MACs              []string `toml:"macs"`
+	HostKeyAlgorithms []string `toml:"host_key_algorithms"`
+	SSHConnTimeWarn   Duration `toml:"ssh_connection_time_warn"`
+	SSHConnectTimeout Duration `toml:"ssh_connect_timeout"`
+	SSHConnTimeFails  int      `toml:"ssh_connection_time_needed_failures"`
+	SSHPersistent     bool     `toml:"ssh_persistent"`
+	SSHKeepalive      Duration `toml:"ssh_keepalive"`
+	Jump              tomlJump
+	KnownHosts        string `toml:"known_hosts"`
 }
 
 type tomlAuth struct {
@@ -21,17 +34,21 @@ type tomlAuth struct {
 	Password      string
 	Key           string
 	KeyPassphrase string `toml:"key_passphrase"`
-	SSHAgent      bool   `toml:"ssh_agent"`
+	Cert          string
+	SSHAgent      bool `toml:"ssh_agent"`
 	Pubkey        string
 }
 
 type tomlHost struct {
-	Disabled bool
-	Name     string
-	Network  tomlNetwork
-	Auth     tomlAuth
-	Classes  []string
-	Default  []tomlDefault
+	Disabled   bool
+	Name       string
+	Network    tomlNetwork
+	Auth       tomlAuth
+	Classes    []string
+	Default    []tomlDefault
+	RunTimeout Duration `toml:"run_timeout"`
+	Parents    []string
+	Shell      string
 }
 
 func tomlHostToHost(tHost *tomlHost, config *Config, filename string) (*Host, error) {
@@ -42,6 +59,7 @@ func tomlHostToHost(tHost *tomlHost, config *Config, filename string) (*Host, er
 
 	host.Connection = &connection
 	host.Filename = filename
+	host.confHash = MD5Hash(fmt.Sprintf("%+v", *tHost))
 
 	if tHost.Disabled == true && config.loadDisabled == false {
 		return nil, nil
@@ -67,15 +85,67 @@ func tomlHostToHost(tHost *tomlHost, config *Config, filename string) (*Host, er
 	}
 	host.Classes = tHost.Classes
 
+	for _, parent := range tHost.Parents {
+		if parent == host.Name {
+			return nil, errors.New("a host can't be its own parent")
+		}
+	}
+	host.Parents = tHost.Parents
+
+	if tHost.RunTimeout.Duration < (1 * time.Second) {
+		return nil, errors.New("'run_timeout' can't be less than a second")
+	}
+	host.RunTimeout = tHost.RunTimeout.Duration
+
+	switch tHost.Shell {
+	case ShellBash, ShellSh:
+		host.Shell = tHost.Shell
+	default:
+		return nil, fmt.Errorf("invalid shell '%s' (valid: %s, %s)", tHost.Shell, ShellBash, ShellSh)
+	}
+
 	host.Defaults = make(map[string]interface{})
 	if err := checkTomlDefault(host.Defaults, tHost.Default); err != nil {
 		return nil, err
 	}
 
-	if tHost.Network.Host == "" {
-		return nil, errors.New("[network] section, invalid or missing 'host'")
+	switch tHost.Network.Transport {
+	case TransportSSH:
+		if tHost.Network.Command != nil {
+			return nil, errors.New("[network] section, 'command' needs the 'exec' transport")
+		}
+	case TransportLocal, TransportExec:
+		return tomlHostCommandTransport(tHost, &host)
+	default:
+		return nil, fmt.Errorf("[network] section, invalid transport '%s' (valid: %s, %s, %s)", tHost.Network.Transport, TransportSSH, TransportLocal, TransportExec)
+	}
+	host.TransportName = TransportSSH
+	host.Transport = &connection
+
+	if tHost.Network.Host != "" && tHost.Network.Hosts != nil {
+		return nil, errors.New("[network] section, can't use 'host' and 'hosts' at the same time")
+	}
+	connection.Hosts = tHost.Network.Hosts
+	if tHost.Network.Host != "" {
+		connection.Hosts = []string{tHost.Network.Host}
+	}
+	if len(connection.Hosts) == 0 {
+		return nil, errors.New("[network] section, invalid or missing 'host' (or 'hosts')")
+	}
+	for _, h := range connection.Hosts {
+		if h == "" {
+			return nil, errors.New("[network] section, empty address in 'hosts'")
+		}
+	}
+	connection.Host = connection.Hosts[0]
+	connection.hostName = host.Name
+
+	switch tHost.Network.HostsMode {
+	case HostsFailover, HostsRace:
+		connection.HostsMode = tHost.Network.HostsMode
+	default:
+		return nil, fmt.Errorf("[network] section, invalid hosts_mode '%s' (valid: %s, %s)", tHost.Network.HostsMode, HostsFailover, HostsRace)
 	}
-	connection.Host = tHost.Network.Host
 
 	if tHost.Network.Port == 0 {
 		return nil, errors.New("[network] section, invalid or missing 'port'")
@@ -87,68 +157,160 @@ func tomlHostToHost(tHost *tomlHost, config *Config, filename string) (*Host, er
 	}
 	connection.SSHConnTimeWarn = tHost.Network.SSHConnTimeWarn.Duration
 
+	if tHost.Network.SSHConnTimeFails < 1 {
+		return nil, errors.New("'ssh_connection_time_needed_failures' can't be less than 1")
+	}
+	connection.SSHConnTimeNeededFailures = tHost.Network.SSHConnTimeFails
+
+	if tHost.Network.SSHConnectTimeout.Duration < (1 * time.Second) {
+		return nil, errors.New("'ssh_connect_timeout' can't be less than a second")
+	}
+	connection.ConnectTimeout = tHost.Network.SSHConnectTimeout.Duration
+
+	if tHost.Network.SSHKeepalive.Duration < (1 * time.Second) {
+		return nil, errors.New("'ssh_keepalive' can't be less than a second")
+	}
+	if tHost.Network.KnownHosts == "" {
+		return nil, errors.New("[network] section, 'known_hosts' can't be empty")
+	}
+	connection.KnownHosts = tHost.Network.KnownHosts
+
+	connection.Persistent = tHost.Network.SSHPersistent
+	connection.Keepalive = tHost.Network.SSHKeepalive.Duration
+
 	if tHost.Auth.User == "" {
 		return nil, errors.New("[auth] section, invalid or missing 'user'")
 	}
 	connection.User = tHost.Auth.User
-	connection.Ciphers = tHost.Network.Ciphers
 
-	if tHost.Auth.Key != "" && tHost.Auth.Password != "" {
+	connection.Algorithms = SSHAlgorithms{
+		Ciphers:           tHost.Network.Ciphers,
+		KeyExchanges:      tHost.Network.KeyExchanges,
+		MACs:              tHost.Network.MACs,
+		HostKeyAlgorithms: tHost.Network.HostKeyAlgorithms,
+	}
+	if err := connection.Algorithms.Check(); err != nil {
+		return nil, fmt.Errorf("[network] section, %s", err)
+	}
+
+	auths, err := tomlAuthToAuths(&tHost.Auth)
+	if err != nil {
+		return nil, err
+	}
+	connection.Auths = auths
+
+	jumps, err := tomlJumpToHops(&tHost.Network.Jump, config, 0)
+	if err != nil {
+		return nil, fmt.Errorf("[network] section, %s", err)
+	}
+	connection.Jumps = jumps
+	for _, hop := range jumps {
+		// a modified jump host file is a modified host
+		host.confHash = MD5Hash(host.confHash + hop.confHash)
+	}
+
+	return &host, nil
+}
+
+// tomlHostCommandTransport sets up a "local" or "exec" transport for the
+// host ([network] host, port, jump and [auth] section are not used)
+func tomlHostCommandTransport(tHost *tomlHost, host *Host) (*Host, error) {
+	var transport CommandTransport
+
+	if tHost.Network.Transport == TransportExec {
+		if len(tHost.Network.Command) == 0 {
+			return nil, errors.New("[network] section, 'exec' transport needs a 'command'")
+		}
+		transport.Command = tHost.Network.Command
+	} else if tHost.Network.Command != nil {
+		return nil, errors.New("[network] section, 'command' needs the 'exec' transport")
+	}
+
+	if len(tHost.Network.Jump.Hops) > 0 {
+		return nil, fmt.Errorf("[network] section, 'jump' can't be used with '%s' transport", tHost.Network.Transport)
+	}
+
+	host.Connection = nil
+	host.TransportName = tHost.Network.Transport
+	host.Transport = &transport
+	return host, nil
+}
+
+// tomlAuthToAuths checks the [auth] section and returns corresponding
+// SSH auth methods
+func tomlAuthToAuths(tAuth *tomlAuth) ([]ssh.AuthMethod, error) {
+	if tAuth.Key != "" && tAuth.Password != "" {
 		return nil, errors.New("[auth] section, can't use key and password at the same time (see key_passphrase parameter, perhaps?)")
 	}
-	if tHost.Auth.KeyPassphrase != "" && tHost.Auth.Password != "" {
+	if tAuth.KeyPassphrase != "" && tAuth.Password != "" {
 		return nil, errors.New("[auth] section, can't use key_passphrase and password at the same time")
 	}
-	if tHost.Auth.SSHAgent == true && tHost.Auth.Password != "" {
+	if tAuth.SSHAgent == true && tAuth.Password != "" {
 		return nil, errors.New("[auth] section, can't use SSH agent and password at the same time")
 	}
-	if tHost.Auth.SSHAgent == true && tHost.Auth.KeyPassphrase != "" {
+	if tAuth.SSHAgent == true && tAuth.KeyPassphrase != "" {
 		return nil, errors.New("[auth] section, can't use SSH agent and key_passphrase at the same time")
 	}
-	if tHost.Auth.SSHAgent == true && tHost.Auth.Key != "" {
+	if tAuth.SSHAgent == true && tAuth.Key != "" {
 		return nil, errors.New("[auth] section, can't use SSH agent and key at the same time (see pubkey parameter, perhaps?)")
 	}
 
-	if tHost.Auth.Key != "" {
-		fd, err := os.Open(tHost.Auth.Key)
+	if tAuth.Cert != "" && tAuth.Key == "" {
+		return nil, errors.New("[auth] section, 'cert' needs the corresponding 'key'")
+	}
+
+	if tAuth.Key != "" {
+		fd, err := os.Open(tAuth.Key)
 		if err != nil {
-			return nil, fmt.Errorf("can't access to key '%s': %s", tHost.Auth.Key, err)
+			return nil, fmt.Errorf("can't access to key '%s': %s", tAuth.Key, err)
 		}
 		fd.Close()
 	}
 
-	// !!! there's many returns following this line, be careful
-
-	if tHost.Auth.Password != "" {
-		connection.Auths = []ssh.AuthMethod{
-			ssh.Password(tHost.Auth.Password),
-		}
-		return &host, nil
+	if tAuth.Password != "" {
+		return []ssh.AuthMethod{
+			ssh.Password(tAuth.Password),
+		}, nil
 	}
 
-	if tHost.Auth.SSHAgent == true {
-		agent, err := SSHAgent(tHost.Auth.Pubkey)
+	if tAuth.SSHAgent == true {
+		agent, err := SSHAgent(tAuth.Pubkey)
 		if err != nil {
 			return nil, err
 		}
-		connection.Auths = []ssh.AuthMethod{
+		return []ssh.AuthMethod{
 			agent,
+		}, nil
+	}
+
+	if tAuth.Cert != "" {
+		cert, err := CertificateFile(tAuth.Key, tAuth.KeyPassphrase, tAuth.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("[auth] section, %s", err)
 		}
-		return &host, nil
+		return []ssh.AuthMethod{
+			cert,
+		}, nil
 	}
 
-	if tHost.Auth.Key != "" && tHost.Auth.KeyPassphrase == "" {
-		connection.Auths = []ssh.AuthMethod{
-			PublicKeyFile(tHost.Auth.Key),
+	if tAuth.Key != "" && tAuth.KeyPassphrase == "" {
+		key, err := PublicKeyFile(tAuth.Key)
+		if err != nil {
+			return nil, fmt.Errorf("[auth] section, %s", err)
 		}
-		return &host, nil
+		return []ssh.AuthMethod{
+			key,
+		}, nil
 	}
 
-	if tHost.Auth.Key != "" && tHost.Auth.KeyPassphrase != "" {
-		connection.Auths = []ssh.AuthMethod{
-			PublicKeyFilePassPhrase(tHost.Auth.Key, tHost.Auth.KeyPassphrase),
+	if tAuth.Key != "" && tAuth.KeyPassphrase != "" {
+		key, err := PublicKeyFilePassPhrase(tAuth.Key, tAuth.KeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("[auth] section, %s", err)
 		}
-		return &host, nil
+		return []ssh.AuthMethod{
+			key,
+		}, nil
 	}
 
 	return nil, errors.New("[auth] section, at least one auth method is needed (password, key or ssh_agent)")
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/BurntSushi/toml"
+)
+
+// maxJumpHops limits the length of a jump host chain (and catches loops
+// between hosts.d files)
+const maxJumpHops = 8
+
+// tomlJumpHop is a jump host (bastion), given as a hosts.d file name
+// or inline (host, port, [auth], algorithms and known_hosts)
+type tomlJumpHop struct {
+	File       string
+	Host       string
+	Port       int
+	Auth       tomlAuth
+	KnownHosts string `toml:"known_hosts"`
+
+	Ciphers           []string
+	KeyExchanges      []string `toml:"key_exchanges"`
+	MACs              []string `toml:"macs"`
+	HostKeyAlgorithms []string `toml:"host_key_algorithms"`
+}
+
+// tomlJump holds jump hosts, in connection order. In TOML files, it's a
+// string (hosts.d file name), a table (inline jump host) or an array
+// of strings and tables.
+type tomlJump struct {
+	Hops []tomlJumpHop
+}
+
+// UnmarshalTOML is needed to satisfy the toml.Unmarshaler interface
+func (jump *tomlJump) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case []map[string]interface{}:
+		for _, table := range value {
+			if err := jump.addHop(table); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for _, item := range value {
+			if err := jump.addHop(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return jump.addHop(data)
+}
+
+func (jump *tomlJump) addHop(data interface{}) error {
+	var hop tomlJumpHop
+
+	switch value := data.(type) {
+	case string:
+		hop.File = value
+	case map[string]interface{}:
+		// encode the table again, so it's decoded with usual rules
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(value); err != nil {
+			return fmt.Errorf("'jump': %s", err)
+		}
+		if _, err := toml.Decode(buf.String(), &hop); err != nil {
+			return fmt.Errorf("'jump': %s", err)
+		}
+		if hop.File != "" {
+			return errors.New("'jump': can't use 'file' in an inline jump host")
+		}
+	default:
+		return fmt.Errorf("'jump': invalid value type %T (file name or table expected)", data)
+	}
+
+	jump.Hops = append(jump.Hops, hop)
+	return nil
+}
+
+// tomlJumpToHops returns final jump hops, in connection order, resolving
+// hosts.d files (and their own jump hosts)
+func tomlJumpToHops(tJump *tomlJump, config *Config, depth int) ([]*JumpHop, error) {
+	var hops []*JumpHop
+
+	for _, tHop := range tJump.Hops {
+		if tHop.File == "" {
+			hop, err := tomlJumpHopToJumpHop(&tHop, "", config)
+			if err != nil {
+				return nil, err
+			}
+			hops = append(hops, hop)
+			continue
+		}
+
+		if depth >= maxJumpHops {
+			return nil, fmt.Errorf("'jump': too many hops (loop with '%s'?)", tHop.File)
+		}
+
+		file := tHop.File
+		if path.IsAbs(file) == false {
+			file = path.Clean(config.configPath + "/hosts.d/" + file)
+		}
+
+		var tHost tomlHost
+		if _, err := toml.DecodeFile(file, &tHost); err != nil {
+			return nil, fmt.Errorf("'jump': error decoding %s: %s", file, err)
+		}
+
+		// a jump host has a single address (no failover or race between
+		// jump hosts)
+		host := tHost.Network.Host
+		if tHost.Network.Hosts != nil {
+			if host != "" || len(tHost.Network.Hosts) != 1 {
+				return nil, fmt.Errorf("'jump': %s: a jump host needs a single address ('host', or one item in 'hosts')", tHop.File)
+			}
+			host = tHost.Network.Hosts[0]
+		}
+
+		// hops needed to reach this jump host
+		prevHops, err := tomlJumpToHops(&tHost.Network.Jump, config, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, prevHops...)
+
+		fileHop := tomlJumpHop{
+			File:              tHop.File,
+			Host:              host,
+			Port:              tHost.Network.Port,
+			Auth:              tHost.Auth,
+			KnownHosts:        tHost.Network.KnownHosts,
+			Ciphers:           tHost.Network.Ciphers,
+			KeyExchanges:      tHost.Network.KeyExchanges,
+			MACs:              tHost.Network.MACs,
+			HostKeyAlgorithms: tHost.Network.HostKeyAlgorithms,
+		}
+		hop, err := tomlJumpHopToJumpHop(&fileHop, tHop.File, config)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop)
+	}
+
+	if len(hops) > maxJumpHops {
+		return nil, fmt.Errorf("'jump': too many hops (%d, max %d)", len(hops), maxJumpHops)
+	}
+
+	return hops, nil
+}
+
+// tomlJumpHopToJumpHop creates a JumpHop, named after its hosts.d file
+// (or "host:port" for inline jump hosts if name is empty). Missing
+// algorithms are taken from the global configuration, and the host
+// known_hosts file is used if the jump host has none.
+func tomlJumpHopToJumpHop(tHop *tomlJumpHop, name string, config *Config) (*JumpHop, error) {
+	var hop JumpHop
+
+	if tHop.Port == 0 {
+		tHop.Port = 22
+	}
+
+	if name == "" {
+		name = hostPortAddress(tHop.Host, tHop.Port)
+	}
+	hop.Name = name
+	hop.confHash = MD5Hash(fmt.Sprintf("%+v", *tHop))
+
+	if tHop.Host == "" {
+		return nil, fmt.Errorf("jump host '%s': invalid or missing 'host'", name)
+	}
+	hop.Host = tHop.Host
+	hop.Port = tHop.Port
+	hop.KnownHosts = tHop.KnownHosts
+
+	hop.Algorithms = config.SSHAlgorithms
+	if tHop.Ciphers != nil {
+		hop.Algorithms.Ciphers = tHop.Ciphers
+	}
+	if tHop.KeyExchanges != nil {
+		hop.Algorithms.KeyExchanges = tHop.KeyExchanges
+	}
+	if tHop.MACs != nil {
+		hop.Algorithms.MACs = tHop.MACs
+	}
+	if tHop.HostKeyAlgorithms != nil {
+		hop.Algorithms.HostKeyAlgorithms = tHop.HostKeyAlgorithms
+	}
+	if err := hop.Algorithms.Check(); err != nil {
+		return nil, fmt.Errorf("jump host '%s': %s", name, err)
+	}
+
+	if tHop.Auth.User == "" {
+		return nil, fmt.Errorf("jump host '%s': invalid or missing 'user'", name)
+	}
+	hop.User = tHop.Auth.User
+
+	auths, err := tomlAuthToAuths(&tHop.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("jump host '%s': %s", name, err)
+	}
+	hop.Auths = auths
+
+	return &hop, nil
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/Knetic/govaluate"
+	"github.com/robfig/cron/v3"
 )
 
 // Duration hides time.Duration for TOML file reading (see UnmarshalText)
@@ -33,22 +34,33 @@ type tomlDefault struct {
 type tomlCheck struct {
 	Desc            string
 	If              string
+	Type            string
 	Classes         []string
 	NeededFailures  int `toml:"needed_failures"`
 	NeededSuccesses int `toml:"needed_successes"`
 }
 
+// cronParser accepts standard cron specs, with optional seconds, descriptors
+// (@daily, @every 1h, …) and a timezone prefix (CRON_TZ=Europe/Paris …)
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
 type tomlProbe struct {
-	Name      string
-	Disabled  bool
-	Script    string
-	Targets   []string
-	Delay     Duration
-	Timeout   Duration
-	Arguments string
-	Default   []tomlDefault
-	Check     []tomlCheck
-	RunIf     string `toml:"run_if"`
+	Name        string
+	Disabled    bool
+	Script      string
+	Targets     []string
+	Delay       Duration
+	Schedule    string
+	Timeout     Duration
+	Arguments   string
+	Output      string
+	Format      string
+	Default     []tomlDefault
+	Check       []tomlCheck
+	RunIf       string   `toml:"run_if"`
+	DependsOn   []string `toml:"depends_on"`
+	DependsMode string   `toml:"depends_mode"`
+	Labelled    []string
 }
 
 func checkTomlDefault(pDefaults map[string]interface{}, tDefaults []tomlDefault) error {
@@ -98,6 +110,7 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 	probe.Disabled = (tProbe.Disabled == true)
 
 	probe.Filename = filename
+	probe.confHash = MD5Hash(fmt.Sprintf("%+v", *tProbe))
 
 	if tProbe.Name == "" {
 		return nil, errors.New("invalid or missing 'name'")
@@ -120,10 +133,12 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 	}
 	probe.Script = scriptPath
 
-	_, err = ioutil.ReadFile(scriptPath)
+	script, err := ioutil.ReadFile(scriptPath)
 	if err != nil {
 		return nil, fmt.Errorf("error reading script file '%s': %s", scriptPath, err)
 	}
+	// a modified script is a modified probe (see reload)
+	probe.confHash = MD5Hash(probe.confHash + string(script))
 
 	if tProbe.Targets == nil {
 		return nil, errors.New("no valid 'targets' parameter found")
@@ -147,19 +162,31 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 	}
 	probe.Targets = tProbe.Targets
 
-	if tProbe.Delay.Duration == 0 {
-		return nil, errors.New("invalid or missing 'delay'")
+	if tProbe.Delay.Duration != 0 && tProbe.Schedule != "" {
+		return nil, errors.New("can't use 'delay' and 'schedule' at the same time")
 	}
 
-	if tProbe.Delay.Duration < (1 * time.Minute) {
-		return nil, errors.New("'delay' can't be less than a minute")
-	}
+	if tProbe.Schedule != "" {
+		schedule, err := cronParser.Parse(tProbe.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'schedule': %s (\"%s\")", err, tProbe.Schedule)
+		}
+		probe.Schedule = schedule
+		probe.CronSpec = tProbe.Schedule
+	} else {
+		if tProbe.Delay.Duration == 0 {
+			return nil, errors.New("invalid or missing 'delay' (or 'schedule')")
+		}
+
+		if tProbe.Delay.Duration < (1 * time.Second) {
+			return nil, errors.New("'delay' can't be less than a second")
+		}
 
-	minutes := float64(tProbe.Delay.Duration) / float64(time.Minute)
-	if float64(int(minutes)) != minutes {
-		return nil, errors.New("'delay' granularity is in minutes (ex: 5m)")
+		if tProbe.Delay.Duration%time.Second != 0 {
+			return nil, errors.New("'delay' granularity is in seconds (ex: 30s, 5m)")
+		}
+		probe.Delay = tProbe.Delay.Duration
 	}
-	probe.Delay = tProbe.Delay.Duration
 
 	if tProbe.Timeout.Duration == 0 {
 		//~ return nil, errors.New("invalid or missing 'timeout'")
@@ -174,6 +201,26 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 	// should warn about dangerous characters? (;& …)
 	probe.Arguments = tProbe.Arguments
 
+	switch tProbe.Output {
+	case "":
+		tProbe.Output = OutputLines
+	case OutputLines, OutputJSON:
+	default:
+		return nil, fmt.Errorf("invalid 'output' value '%s' (%s or %s)", tProbe.Output, OutputLines, OutputJSON)
+	}
+	probe.Output = tProbe.Output
+
+	switch tProbe.Format {
+	case "":
+	case OutputNagios:
+		if probe.Output != OutputLines {
+			return nil, fmt.Errorf("can't use 'output' with 'format = \"%s\"'", OutputNagios)
+		}
+		probe.Output = OutputNagios
+	default:
+		return nil, fmt.Errorf("invalid 'format' value '%s' (only %s)", tProbe.Format, OutputNagios)
+	}
+
 	if tProbe.RunIf != "" {
 		expr, err := govaluate.NewEvaluableExpressionWithFunctions(tProbe.RunIf, CheckFunctions)
 		if err != nil {
@@ -185,6 +232,29 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 		probe.RunIf = expr
 	}
 
+	for _, name := range tProbe.DependsOn {
+		if name == probe.Name {
+			return nil, errors.New("a probe can't depend on itself")
+		}
+	}
+	probe.DependsOn = tProbe.DependsOn
+
+	switch tProbe.DependsMode {
+	case "":
+		tProbe.DependsMode = DependsSkip
+	case DependsSkip, DependsSuppress:
+	default:
+		return nil, fmt.Errorf("invalid 'depends_mode' value '%s' (%s or %s)", tProbe.DependsMode, DependsSkip, DependsSuppress)
+	}
+	probe.DependsMode = tProbe.DependsMode
+
+	for _, name := range tProbe.Labelled {
+		if !IsValidTokenName(name) || !IsAllUpper(name) {
+			return nil, fmt.Errorf("invalid 'labelled' value name '%s' (upper case token needed)", name)
+		}
+	}
+	probe.Labelled = tProbe.Labelled
+
 	probe.Defaults = make(map[string]interface{})
 	if err := checkTomlDefault(probe.Defaults, tProbe.Default); err != nil {
 		return nil, err
@@ -209,6 +279,14 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 		}
 		check.If = expr
 
+		if tCheck.Type == "" {
+			tCheck.Type = ValueAuto
+		}
+		if IsValidValueType(tCheck.Type) == false {
+			return nil, fmt.Errorf("[[check]] invalid 'type' value '%s' (%s, %s, %s or %s)", tCheck.Type, ValueAuto, ValueNumber, ValueBool, ValueString)
+		}
+		check.Type = tCheck.Type
+
 		if tCheck.Classes == nil {
 			return nil, errors.New("no valid 'classes' parameter found")
 		}
@@ -236,6 +314,15 @@ func tomlProbeToProbe(tProbe *tomlProbe, config *Config, filename string) (*Prob
 		probe.Checks = append(probe.Checks, &check)
 	}
 
+	if probe.Output == OutputNagios {
+		checks, err := nagiosImplicitChecks()
+		if err != nil {
+			return nil, fmt.Errorf("Nagios implicit checks: %s", err)
+		}
+		probe.Checks = append(probe.Checks, checks...)
+		probe.Labelled = append(probe.Labelled, NagiosPerfValue, NagiosWarnValue, NagiosCritValue, NagiosMinValue, NagiosMaxValue)
+	}
+
 	if miss := probe.MissingDefaults(); len(miss) > 0 {
 		return nil, fmt.Errorf("missing defaults (used in 'if' expressions or 'arguments' parameter): %s", strings.Join(miss, ", "))
 	}
@@ -18,10 +18,25 @@ type CurrentFail struct {
 	OkCount   int
 	UniqueID  string
 
-	// optional "payload"
-	RelatedTask  *Task // for Checks (!!)
-	RelatedHost  *Host // for Runs
-	RelatedTTask *Task // for Tasks
+	// name of a down parent host or of a failing probe dependency, when
+	// the alert of this fail was held back (replaced by an "unreachable"
+	// notice, or not sent at all)
+	HeldBackBy string
+
+	// instance label of a per-instance check fail, and the hash of the
+	// check itself (shared by all its instances)
+	Label     string
+	CheckHash string
+
+	// names of the failing host and of its probe (if any), saved so the
+	// payload can be linked again once loaded (see CurrentFailsLink)
+	Host  string
+	Probe string
+
+	// optional "payload" (not saved)
+	RelatedTask  *Task `json:"-"` // for Checks (!!)
+	RelatedHost  *Host `json:"-"` // for Runs
+	RelatedTTask *Task `json:"-"` // for Tasks
 }
 
 var (
@@ -36,38 +51,43 @@ func CurrentFailsCreate() {
 	currentFails = make(map[string]*CurrentFail)
 }
 
+// currentFailsWrite dumps current alerts to disk, replacing the previous
+// file atomically (the mutex must be held by the caller)
+func currentFailsWrite() {
+	path := path.Clean(GlobalConfigGet().SavePath + "/" + statusFile)
+	if err := SaveJSONFile(path, &currentFails); err != nil {
+		Error.Printf("can't save fails: %s (see save_path param?)", err)
+		return
+	}
+	Info.Printf("current fails successfully saved to '%s'", path)
+}
+
 // CurrentFailsSave dumps current alerts to disk
 func CurrentFailsSave() {
 	// doing this in a go routine allows this function to be called
 	// by functions that are already locking the mutex
+	backgroundJobs.Add(1)
 	go func() {
+		defer backgroundJobs.Done()
 		currentFailsMutex.Lock()
 		defer currentFailsMutex.Unlock()
-
-		path := path.Clean(GlobalConfig.SavePath + "/" + statusFile)
-		f, err := os.Create(path)
-		if err != nil {
-			Error.Printf("can't save fails in '%s': %s (see save_path param?)", path, err)
-			return
-		}
-		defer f.Close()
-
-		enc := json.NewEncoder(f)
-		err = enc.Encode(&currentFails)
-		if err != nil {
-			Error.Printf("fails json encode: %s", err)
-			return
-		}
-		Info.Printf("current fails successfully saved to '%s'", path)
+		currentFailsWrite()
 	}()
 }
 
+// CurrentFailsFlush synchronously dumps current alerts to disk
+func CurrentFailsFlush() {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+	currentFailsWrite()
+}
+
 // CurrentFailsLoad will load from disk previous "fails"
 func CurrentFailsLoad() {
 	currentFailsMutex.Lock()
 	defer currentFailsMutex.Unlock()
 
-	path := path.Clean(GlobalConfig.SavePath + "/" + statusFile)
+	path := path.Clean(GlobalConfigGet().SavePath + "/" + statusFile)
 	f, err := os.Open(path)
 	if err != nil {
 		Warning.Printf("can't read previous status: %s, no fails loaded", err)
@@ -83,6 +103,117 @@ func CurrentFailsLoad() {
 	Info.Printf("'%s' loaded: %d fail(s)", path, len(currentFails))
 }
 
+// CurrentFailsLink links loaded fails to the Host or Task they're
+// about (Related* payloads) and deletes fails of hosts, tasks or checks
+// that are no longer configured
+func CurrentFailsLink(hosts []*Host) {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+
+	byName := make(map[string]*Host)
+	for _, host := range hosts {
+		byName[host.Name] = host
+	}
+
+	for hash, cf := range currentFails {
+		if cf.Host == "" {
+			continue // not about a host
+		}
+		host, exists := byName[cf.Host]
+		if exists == false {
+			Info.Printf("deleting fail '%s' (host removed)", cf.UniqueID)
+			delete(currentFails, hash)
+			continue
+		}
+		if cf.Probe == "" {
+			if hash == runFailHash(host.Name) {
+				cf.RelatedHost = host
+			}
+			continue
+		}
+
+		var task *Task
+		for _, t := range host.Tasks {
+			if t.Probe.Name == cf.Probe {
+				task = t
+			}
+		}
+		if task == nil {
+			Info.Printf("deleting fail '%s' (task removed)", cf.UniqueID)
+			delete(currentFails, hash)
+			continue
+		}
+		if cf.CheckHash == "" {
+			cf.RelatedTTask = task
+			continue
+		}
+
+		found := false
+		for _, check := range task.Probe.Checks {
+			if checkFailHash(host.Name, task.Probe.Name, check, "") == cf.CheckHash {
+				found = true
+			}
+		}
+		if found == false {
+			Info.Printf("deleting fail '%s' (check removed)", cf.UniqueID)
+			delete(currentFails, hash)
+			continue
+		}
+		cf.RelatedTask = task
+	}
+	CurrentFailsSave()
+}
+
+// CurrentFailsLoaded returns true if current fails are tracked (by the
+// monitoring daemon, not by commands like check or test)
+func CurrentFailsLoaded() bool {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+	return currentFails != nil
+}
+
+// CurrentFailExists returns true if there's a CurrentFail with the given hash
+func CurrentFailExists(hash string) bool {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+	_, exists := currentFails[hash]
+	return exists
+}
+
+// CurrentFailGet returns the CurrentFail with the given hash (or nil)
+func CurrentFailGet(hash string) *CurrentFail {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+	return currentFails[hash]
+}
+
+// CurrentCheckInstanceFails returns every CurrentFail of instances (see
+// CurrentFail.Label) of the check with the given hash
+func CurrentCheckInstanceFails(checkHash string) []*CurrentFail {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+	var fails []*CurrentFail
+	for _, cf := range currentFails {
+		if cf.CheckHash == checkHash && cf.Label != "" {
+			fails = append(fails, cf)
+		}
+	}
+	return fails
+}
+
+// CurrentTaskFailExists returns true if there's a CurrentFail for
+// an error of this task
+func CurrentTaskFailExists(task *Task) bool {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+	for _, cf := range currentFails {
+		if cf.RelatedTTask == task {
+			return true
+		}
+	}
+	return false
+}
+
 // CurrentFailDelete deleted the CurrentFail with the given hash of the global currentFails
 func CurrentFailDelete(hash string) {
 	currentFailsMutex.Lock()
@@ -146,3 +277,44 @@ func CurrentFailGetAndDec(hash string) *CurrentFail {
 	CurrentFailDec(hash)
 	return cf
 }
+
+// CurrentFailsRemap updates currentFails after a configuration reload:
+// Related* payloads pointing to an old Host or Task are replaced by the
+// new one, and fails of removed hosts/tasks (nil in maps) are deleted.
+// Check fails are only kept if their hash is still in checkHashes.
+func CurrentFailsRemap(hosts map[*Host]*Host, tasks map[*Task]*Task, checkHashes map[string]bool) {
+	currentFailsMutex.Lock()
+	defer currentFailsMutex.Unlock()
+
+	for hash, cf := range currentFails {
+		if host, exists := hosts[cf.RelatedHost]; exists == true {
+			if host == nil {
+				Info.Printf("deleting fail '%s' (host removed)", cf.UniqueID)
+				delete(currentFails, hash)
+				continue
+			}
+			cf.RelatedHost = host
+		}
+		if task, exists := tasks[cf.RelatedTTask]; exists == true {
+			if task == nil {
+				Info.Printf("deleting fail '%s' (task removed)", cf.UniqueID)
+				delete(currentFails, hash)
+				continue
+			}
+			cf.RelatedTTask = task
+		}
+		if task, exists := tasks[cf.RelatedTask]; exists == true {
+			checkHash := hash
+			if cf.CheckHash != "" {
+				checkHash = cf.CheckHash
+			}
+			if task == nil || checkHashes[checkHash] == false {
+				Info.Printf("deleting fail '%s' (check removed)", cf.UniqueID)
+				delete(currentFails, hash)
+				continue
+			}
+			cf.RelatedTask = task
+		}
+	}
+	CurrentFailsSave()
+}
@@ -8,10 +8,6 @@ echo "FULLEST_PERC:" $fullest
 all=$(echo "$lines" | awk '{print $5,$6}')
 while read -r line; do
     dfree=$(echo "$line" | awk '{print $1}' | cut -d% -f1)
-    name=$(echo "$line" | awk '{print $2}')
-    name=$(echo "$name" | sed 's#/#_#g' |sed 's/-/_/' | sed 's/^_//')
-    if [ -z "$name" ]; then
-	name="ROOT"
-    fi
-    echo "DF_${name^^}_PERC:" $dfree
+    mount=$(echo "$line" | awk '{print $2}')
+    echo "DISK_PERC[$mount]:" $dfree
 done <<< "$all"
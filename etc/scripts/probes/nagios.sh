@@ -0,0 +1,6 @@
+#!/bin/sh
+
+# runs any Nagios plugin, given with its arguments (see nagios_load.toml);
+# not with exec: the shell must remain, to clean up after the plugin
+"$@"
+exit $?
@@ -6,6 +6,7 @@ require (
 	github.com/BurntSushi/toml v1.2.0
 	github.com/Knetic/govaluate v3.0.0+incompatible
 	github.com/fatih/color v1.13.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/urfave/cli v1.22.9
 	golang.org/x/crypto v0.0.0-20220817201139-bc19a97f63c8
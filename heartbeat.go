@@ -50,7 +50,7 @@ func heartbeatsList(config *Config) ([]string, error) {
 
 func heartbeatExecute(script string) {
 	varMap := make(map[string]interface{})
-	varMap["NOSEE_SRV"] = GlobalConfig.Name
+	varMap["NOSEE_SRV"] = GlobalConfigGet().Name
 	varMap["VERSION"] = NoseeVersion
 	varMap["DATETIME"] = time.Now().Format(time.RFC3339)
 	varMap["STARTTIME"] = appStartTime.Format(time.RFC3339)
@@ -77,13 +77,39 @@ func heartbeatsExecute(scripts []string) {
 	}
 }
 
+// heartbeatsStop and heartbeatsDone are the channels of the
+// heartbeatsSchedule goroutine (nil if not started)
+var (
+	heartbeatsStop chan struct{}
+	heartbeatsDone chan struct{}
+)
+
 func heartbeatsSchedule(scripts []string, delay time.Duration) {
+	heartbeatsStop = make(chan struct{})
+	heartbeatsDone = make(chan struct{})
+
 	go func() {
+		defer close(heartbeatsDone)
 		for {
 			heartbeatsExecute(scripts)
 			Info.Printf("heartbeat, %d scripts", len(scripts))
 			// should check total exec duration and compare to delay, here!
-			time.Sleep(delay)
+			select {
+			case <-heartbeatsStop:
+				return
+			case <-time.After(delay):
+			}
 		}
 	}()
 }
+
+// heartbeatsUnschedule stops the heartbeatsSchedule goroutine and waits
+// for current heartbeat scripts to end
+func heartbeatsUnschedule() {
+	if heartbeatsStop == nil {
+		return
+	}
+	close(heartbeatsStop)
+	<-heartbeatsDone
+	heartbeatsStop = nil
+}
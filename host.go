@@ -1,20 +1,26 @@
 package main
 
 import (
-	"fmt"
 	"strings"
 	"time"
 )
 
 // Host is the final form of hosts.d files
 type Host struct {
-	Name       string
-	Filename   string
-	Disabled   bool
-	Classes    []string
-	Connection *Connection
-	Defaults   map[string]interface{}
-	Tasks      []*Task
+	Name          string
+	Filename      string
+	Disabled      bool
+	Classes       []string
+	Transport     Transport
+	TransportName string
+	Connection    *Connection // SSH transport only (nil otherwise)
+	Shell         string
+	Defaults      map[string]interface{}
+	Tasks         []*Task
+	RunTimeout    time.Duration
+	Parents       []string
+
+	confHash string
 }
 
 // HasClass returns true if this Host has this class
@@ -50,53 +56,136 @@ func (host *Host) MatchProbeTargets(probe *Probe) bool {
 	return false
 }
 
-// Schedule will loop forever, creating and executing runs for this host
-func (host *Host) Schedule() {
+// TaskByProbeName returns the task of this Host using the named probe,
+// or nil if there's no such task
+func (host *Host) TaskByProbeName(name string) *Task {
+	for _, task := range host.Tasks {
+		if task.Probe.Name == name {
+			return task
+		}
+	}
+	return nil
+}
+
+// DownParent returns the name of the first parent of this Host with
+// a current run failure, or an empty string if all parents are up
+func (host *Host) DownParent() string {
+	for _, parent := range host.Parents {
+		if CurrentFailExists(runFailHash(parent)) {
+			return parent
+		}
+	}
+	return ""
+}
+
+// SameAs returns true if other Host has the same configuration and the
+// same tasks (probes with the same configuration) as this Host
+func (host *Host) SameAs(other *Host) bool {
+	if host.confHash != other.confHash || len(host.Tasks) != len(other.Tasks) {
+		return false
+	}
+	for i, task := range host.Tasks {
+		if task.Probe.Name != other.Tasks[i].Probe.Name || task.Probe.confHash != other.Tasks[i].Probe.confHash {
+			return false
+		}
+	}
+	return true
+}
+
+// nextRun returns the time of the next due task of this Host (or
+// the zero time if there's no task at all)
+func (host *Host) nextRun() time.Time {
+	var next time.Time
+	for _, task := range host.Tasks {
+		if next.IsZero() || task.NextRun.Before(next) {
+			next = task.NextRun
+		}
+	}
+	return next
+}
+
+// Schedule will loop, creating and executing runs for this host, until
+// the stop channel is closed. Every task is woken at its own NextRun, and
+// tasks that are due at the same moment are grouped in the same Run. The
+// wake channel forces every delay-based task to run immediately (tasks
+// with a schedule keep their next planned time).
+func (host *Host) Schedule(stop <-chan struct{}, wake <-chan struct{}) {
+	defer host.Transport.Disconnect()
+
 	for {
-		start := time.Now()
-
-		var run Run
-		run.Host = host
-		run.StartTime = start
-
-		for _, task := range host.Tasks {
-			if start.After(task.NextRun) || start.Equal(task.NextRun) {
-				taskable, err := task.Taskable()
-				if err != nil {
-					Trace.Printf("Taskable() failed: %s", err)
-					run.addError(err)
-					continue
-				}
-				if taskable == false {
-					Info.Printf("host '%s', paused task '%s'\n", host.Name, task.Probe.Name)
+		var wakeup <-chan time.Time
+		if next := host.nextRun(); next.IsZero() == false {
+			wakeup = time.After(time.Until(next))
+		}
+
+		select {
+		case <-stop:
+			Info.Printf("host '%s', scheduling stopped", host.Name)
+			return
+		case <-wakeup:
+		case <-wake:
+			Info.Printf("host '%s', woken up, running delay-based tasks", host.Name)
+			now := time.Now()
+			for _, task := range host.Tasks {
+				if task.Probe.Schedule != nil {
 					continue
 				}
-
-				task.ReSchedule(start.Add(task.Probe.Delay))
-				Info.Printf("host '%s', running task '%s'\n", host.Name, task.Probe.Name)
-				run.Tasks = append(run.Tasks, task)
+				task.NextRun = now
 			}
 		}
 
-		if len(run.Tasks) > 0 {
-			run.Go()
-			run.Alerts()
-			Trace.Printf("currentFails count = %d\n", len(currentFails))
-			loggersExec(&run)
-		}
-		Info.Printf("host '%s', run ended", host.Name)
+		host.runDueTasks(time.Now())
+		Trace.Printf("(loop %s)\n", host.Name)
+	}
+}
 
-		end := time.Now()
-		dur := end.Sub(start)
+// runDueTasks creates and executes a Run with all tasks that are due
+func (host *Host) runDueTasks(start time.Time) {
+	var run Run
+	run.Host = host
+	run.StartTime = start
+
+	// truncated, so tasks with the same delay stay grouped together
+	base := start.Truncate(time.Second)
+
+	for _, task := range host.Tasks {
+		if start.After(task.NextRun) || start.Equal(task.NextRun) {
+			taskable, err := task.Taskable()
+			if err != nil {
+				Trace.Printf("Taskable() failed: %s", err)
+				run.addError(err)
+				task.Retry(base)
+				continue
+			}
+			if taskable == false {
+				Info.Printf("host '%s', paused task '%s'\n", host.Name, task.Probe.Name)
+				task.Postpone(base)
+				continue
+			}
+			if task.Probe.DependsMode == DependsSkip {
+				if dep := task.FailingDependency(host.Name); dep != "" {
+					Info.Printf("host '%s', skipped task '%s' (depends on failing '%s')\n", host.Name, task.Probe.Name, dep)
+					task.Postpone(base)
+					continue
+				}
+			}
 
-		if dur < time.Minute {
-			remains := time.Minute - dur
-			time.Sleep(remains)
-		} else {
-			run.addError(fmt.Errorf("run duration was too long (%s)", run.Duration))
+			task.ReSchedule(base)
+			Info.Printf("host '%s', running task '%s'\n", host.Name, task.Probe.Name)
+			run.Tasks = append(run.Tasks, task)
 		}
-		Trace.Printf("(loop %s)\n", host.Name)
 	}
+
+	if len(run.Tasks) > 0 {
+		run.Go()
+		run.Alerts()
+		// after checks, so states of tasks with check errors are not saved
+		run.SaveStates()
+		Trace.Printf("currentFails count = %d\n", len(currentFails))
+		loggersExec(&run)
+	}
+	TaskSchedulesUpdate(host)
+	Info.Printf("host '%s', run ended", host.Name)
 }
 
 // TestConnection will return nil if connection to the host was successful
@@ -104,32 +193,28 @@ func (host *Host) TestConnection() error {
 
 	//const bootstrap = "bash -s --"
 
-	startTime := time.Now()
+	release := globalRunQueue.Acquire(host)
+	defer release()
 
-	channel := make(chan error, 1)
-	go func() {
-		if err := host.Connection.Connect(); err != nil {
-			channel <- err
-		}
-		defer host.Connection.Close()
-		channel <- nil
-	}()
+	startTime := time.Now()
 
-	connTimeout := host.Connection.SSHConnTimeWarn * 2
+	// SSH connections are limited by ssh_connect_timeout
+	if err := host.Transport.Connect(); err != nil {
+		return err
+	}
+	defer host.Transport.Disconnect()
 
-	select {
-	case err := <-channel:
-		if err != nil {
-			return err
-		}
-	case <-time.After(connTimeout):
-		return fmt.Errorf("SSH connection timeout (after %s)", connTimeout)
+	if host.Connection == nil {
+		Info.Printf("Connection to '%s' OK (%s transport)", host.Name, host.TransportName)
+		return nil
 	}
 
 	dialDuration := time.Now().Sub(startTime)
+	timings := host.Connection.Timings()
 
+	// not an error, see Run.AlertsForDial
 	if dialDuration > host.Connection.SSHConnTimeWarn {
-		return fmt.Errorf("SSH connection time was too long: %s (ssh_connection_time_warn = %s)", dialDuration, host.Connection.SSHConnTimeWarn)
+		Warning.Printf("SSH connection time to '%s' was too long: %s (ssh_connection_time_warn = %s, %s)", host.Name, dialDuration, host.Connection.SSHConnTimeWarn, &timings)
 	}
 
 	/*if err := run.prepareTestPipes(); err != nil {
@@ -139,7 +224,7 @@ func (host *Host) TestConnection() error {
 	/*if err := host.TestRun(bootstrap); err != nil {
 		return err
 	}*/
-	Info.Printf("Connection to '%s' OK (%s)", host.Name, dialDuration)
+	Info.Printf("Connection to '%s' OK (%s, %s)", host.Name, dialDuration, &timings)
 
 	return nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Nosee's own host key store, in known_hosts format: keys pinned with
+// the "trust" command, or trusted on first use (ssh_trust_on_first_use)
+const hostKeysFile string = "nosee-known_hosts"
+
+var (
+	hostKeysMutex sync.Mutex
+
+	// host key changes already alerted (see hostKeyChanged)
+	hostKeyAlerts = make(map[string]bool)
+)
+
+func hostKeysPath() string {
+	return path.Clean(GlobalConfigGet().SavePath + "/" + hostKeysFile)
+}
+
+// HostKeyStorePin saves the key of the host (address) in the host key
+// store, replacing any previous key of this host
+func HostKeyStorePin(address string, key ssh.PublicKey) error {
+	hostKeysMutex.Lock()
+	defer hostKeysMutex.Unlock()
+
+	path := hostKeysPath()
+	host := knownhosts.Normalize(address)
+
+	var buf bytes.Buffer
+	content, err := ioutil.ReadFile(path)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == host {
+			continue
+		}
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString(knownhosts.Line([]string{host}, key) + "\n")
+
+	if err := SaveFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+	Info.Printf("host key of '%s' saved to '%s' (%s %s)", host, path, key.Type(), ssh.FingerprintSHA256(key))
+	return nil
+}
+
+// hostKeyKnownHosts returns a knownhosts callback using the host key store
+// and the given known_hosts file (in that order, so pinned keys win)
+func hostKeyKnownHosts(knownHosts string) (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range []string{hostKeysPath(), knownHosts} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			Trace.Printf("host keys: skipping '%s' (%s)", file, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return knownhosts.New(files...)
+}
+
+// hostKeyChanged rings a 'general' alert when the host key of a host
+// is not the expected one (only once for a given key)
+func hostKeyChanged(address string, want []knownhosts.KnownKey, key ssh.PublicKey) {
+	hostKeysMutex.Lock()
+	hash := MD5Hash(address + ssh.FingerprintSHA256(key))
+	alerted := hostKeyAlerts[hash]
+	hostKeyAlerts[hash] = true
+	hostKeysMutex.Unlock()
+
+	if alerted == true {
+		return
+	}
+
+	var details bytes.Buffer
+
+	details.WriteString("Someone could be eavesdropping on you right now (man-in-the-middle attack),\n")
+	details.WriteString("or the host key has just been changed. No connection will be made.\n")
+	details.WriteString("\n")
+	details.WriteString("Expected key(s):\n")
+	for _, known := range want {
+		details.WriteString(fmt.Sprintf("- %s %s (%s:%d)\n", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+	}
+	details.WriteString("Received key:\n")
+	details.WriteString(fmt.Sprintf("- %s %s\n", key.Type(), ssh.FingerprintSHA256(key)))
+	details.WriteString("\n")
+	details.WriteString("If this change is expected, use the 'trust' command to pin the new key.\n")
+
+	message := AlertMessageCreateForConnection(AlertBad, address, "host key has changed!", "The host key of "+address+" is not the expected one.", details.String(), uuid.NewV4().String())
+	message.RingAlerts()
+}
@@ -50,7 +50,7 @@ func loggersList(config *Config) ([]string, error) {
 
 func loggersExec(run *Run) {
 	varMap := make(map[string]interface{})
-	varMap["NOSEE_SRV"] = GlobalConfig.Name
+	varMap["NOSEE_SRV"] = GlobalConfigGet().Name
 	varMap["VERSION"] = NoseeVersion
 	varMap["HOST_NAME"] = run.Host.Name
 	varMap["HOST_FILE"] = run.Host.Filename
@@ -65,8 +65,10 @@ func loggersExec(run *Run) {
 		}
 	}
 
+	backgroundJobs.Add(1)
 	go func() {
-		for _, script := range globalLogers {
+		defer backgroundJobs.Done()
+		for _, script := range globalLogersGet() {
 			cmd := exec.Command(script)
 
 			// we inject Values thru stdin:
@@ -1,20 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/Knetic/govaluate"
 	"github.com/fatih/color"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
 )
 
 // NoseeVersion in X.Y string format
@@ -78,9 +81,36 @@ func createProbes(ctx *cli.Context, config *Config) ([]*Probe, error) {
 		}
 	}
 	Info.Printf("probe count = %d\n", len(probes))
+
+	if err := checkProbesDependencies(probes); err != nil {
+		return nil, err
+	}
+
 	return probes, nil
 }
 
+// checkProbesDependencies ensures that every probe dependency exists and
+// that there's no loop in dependencies
+func checkProbesDependencies(probes []*Probe) error {
+	graph := make(map[string][]string)
+	for _, probe := range probes {
+		graph[probe.Name] = probe.DependsOn
+	}
+
+	for _, probe := range probes {
+		for _, name := range probe.DependsOn {
+			if _, exists := graph[name]; exists == false {
+				return fmt.Errorf("Config error: probe '%s' depends on an unknown probe '%s'", probe.Name, name)
+			}
+		}
+	}
+
+	if loop := FindLoop(graph); loop != nil {
+		return fmt.Errorf("Config error: probe dependency loop detected (%s)", strings.Join(loop, " -> "))
+	}
+	return nil
+}
+
 func createAlerts(ctx *cli.Context, config *Config) ([]*Alert, error) {
 	alertdFiles, err := configurationDirList("alerts.d", config.configPath)
 	if err != nil {
@@ -128,10 +158,35 @@ func createAlerts(ctx *cli.Context, config *Config) ([]*Alert, error) {
 	return alerts, nil
 }
 
-func createHosts(ctx *cli.Context, config *Config) ([]*Host, error) {
+func testHostsConnections(hosts []*Host) error {
+	Info.Print("Testing connections…")
+	errors := make(chan error, len(hosts))
+	for _, host := range hosts {
+		go func(host *Host) {
+			if err := host.TestConnection(); err != nil {
+				errors <- fmt.Errorf("Error connecting %s: %s", host.Name, err)
+			} else {
+				errors <- nil
+			}
+		}(host)
+	}
+	for i := 0; i < len(hosts); i++ {
+		select {
+		case err := <-errors:
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadHosts reads hosts, probes and alerts configuration and returns
+// hosts (with their tasks) and alerts, without any global side effect
+func loadHosts(ctx *cli.Context, config *Config) ([]*Host, []*Alert, error) {
 	hostsdFiles, errc := configurationDirList("hosts.d", config.configPath)
 	if errc != nil {
-		return nil, fmt.Errorf("Error: %s", errc)
+		return nil, nil, fmt.Errorf("Error: %s", errc)
 	}
 
 	var hosts []*Host
@@ -141,21 +196,34 @@ func createHosts(ctx *cli.Context, config *Config) ([]*Host, error) {
 		var tHost tomlHost
 
 		// defaults
+		tHost.Network.Transport = TransportSSH
+		tHost.Network.HostsMode = HostsFailover
 		tHost.Network.SSHConnTimeWarn.Duration = config.SSHConnTimeWarn
+		tHost.Network.SSHConnectTimeout.Duration = config.SSHConnectTimeout
+		tHost.Network.SSHConnTimeFails = config.SSHConnTimeFails
+		tHost.RunTimeout.Duration = config.RunTimeout
+		tHost.Shell = ShellBash
+		tHost.Network.SSHPersistent = config.SSHPersistent
+		tHost.Network.SSHKeepalive.Duration = config.SSHKeepalive
+		tHost.Network.KnownHosts = config.KnownHosts
+		tHost.Network.Ciphers = config.SSHAlgorithms.Ciphers
+		tHost.Network.KeyExchanges = config.SSHAlgorithms.KeyExchanges
+		tHost.Network.MACs = config.SSHAlgorithms.MACs
+		tHost.Network.HostKeyAlgorithms = config.SSHAlgorithms.HostKeyAlgorithms
 
 		if _, err := toml.DecodeFile(file, &tHost); err != nil {
-			return nil, fmt.Errorf("Error decoding %s: %s", file, err)
+			return nil, nil, fmt.Errorf("Error decoding %s: %s", file, err)
 		}
 
 		_, filename := path.Split(file)
 		host, err := tomlHostToHost(&tHost, config, filename)
 		if err != nil {
-			return nil, fmt.Errorf("Error using %s: %s", file, err)
+			return nil, nil, fmt.Errorf("Error using %s: %s", file, err)
 		}
 
 		if host != nil {
 			if f, exists := hNames[host.Name]; exists == true {
-				return nil, fmt.Errorf("Config error: duplicate name '%s' (%s, %s)", host.Name, f, file)
+				return nil, nil, fmt.Errorf("Config error: duplicate name '%s' (%s, %s)", host.Name, f, file)
 			}
 
 			hosts = append(hosts, host)
@@ -164,36 +232,24 @@ func createHosts(ctx *cli.Context, config *Config) ([]*Host, error) {
 	}
 	Info.Printf("host count = %d\n", len(hosts))
 
+	if err := checkHostsParents(hosts); err != nil {
+		return nil, nil, err
+	}
+
 	if config.doConnTest == true {
-		Info.Print("Testing connections…")
-		errors := make(chan error, len(hosts))
-		for _, host := range hosts {
-			go func(host *Host) {
-				if err := host.TestConnection(); err != nil {
-					errors <- fmt.Errorf("Error connecting %s: %s", host.Name, err)
-				} else {
-					errors <- nil
-				}
-			}(host)
-		}
-		for i := 0; i < len(hosts); i++ {
-			select {
-			case err := <-errors:
-				if err != nil {
-					return nil, err
-				}
-			}
+		if err := testHostsConnections(hosts); err != nil {
+			return nil, nil, err
 		}
 	}
 
 	probes, err := createProbes(ctx, config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	globalAlerts, err = createAlerts(ctx, config)
+	alerts, err := createAlerts(ctx, config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// update hosts with tasks
@@ -205,34 +261,62 @@ func createHosts(ctx *cli.Context, config *Config) ([]*Host, error) {
 				task.Probe = probe
 				task.PrevRun = time.Now()
 				task.NextRun = time.Now()
+				if probe.Schedule != nil {
+					task.NextRun = probe.Schedule.Next(task.NextRun)
+				}
 				host.Tasks = append(host.Tasks, &task)
 				taskCount++
 			}
 		}
 	}
+
+	// link tasks to the tasks they depend on (same host)
+	for _, host := range hosts {
+		for _, task := range host.Tasks {
+			for _, name := range task.Probe.DependsOn {
+				dep := host.TaskByProbeName(name)
+				if dep == nil {
+					Warning.Printf("host '%s': probe '%s' depends on '%s', but this probe does not target this host (ignored)", host.Name, task.Probe.Name, name)
+					continue
+				}
+				task.DependsOn = append(task.DependsOn, dep)
+			}
+		}
+	}
 	Info.Printf("task count = %d\n", taskCount)
 
-	return hosts, nil
+	return hosts, alerts, nil
 }
 
-func scheduleHosts(hosts []*Host, config *Config) error {
-	var hostGroup sync.WaitGroup
-	for i, host := range hosts {
-		hostGroup.Add(1)
-		go func(i int, host *Host) {
-			defer hostGroup.Done()
-			if config.StartTimeSpreadSeconds > 0 {
-				// Sleep here, to ease global load
-				fact := float32(i) / float32(len(hosts)) * 1000 * float32(config.StartTimeSpreadSeconds)
-				wait := time.Duration(fact) * time.Millisecond
-				time.Sleep(wait)
+// checkHostsParents ensures that every host parent exists and that
+// there's no loop in parent relations
+func checkHostsParents(hosts []*Host) error {
+	graph := make(map[string][]string)
+	for _, host := range hosts {
+		graph[host.Name] = host.Parents
+	}
+
+	for _, host := range hosts {
+		for _, parent := range host.Parents {
+			if _, exists := graph[parent]; exists == false {
+				return fmt.Errorf("Config error: host '%s' has an unknown parent '%s'", host.Name, parent)
 			}
-			host.Schedule()
-		}(i, host)
+		}
+	}
+
+	if loop := FindLoop(graph); loop != nil {
+		return fmt.Errorf("Config error: parent loop detected (%s)", strings.Join(loop, " -> "))
 	}
+	return nil
+}
 
-	hostGroup.Wait()
-	return fmt.Errorf("QUIT: empty wait group, everyone died :(")
+func createHosts(ctx *cli.Context, config *Config) ([]*Host, error) {
+	hosts, alerts, err := loadHosts(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	globalAlerts = alerts
+	return hosts, nil
 }
 
 func mainDefault(ctx *cli.Context) error {
@@ -244,6 +328,7 @@ func mainDefault(ctx *cli.Context) error {
 		return cli.NewExitError("", 1)
 	}
 	GlobalConfig = config
+	globalRunQueue.SetLimits(config.MaxConcurrentRuns, config.MaxConcurrentRunsPerClass)
 
 	heartbeats, err := heartbeatsList(config)
 	if err != nil {
@@ -265,6 +350,8 @@ func mainDefault(ctx *cli.Context) error {
 
 	CurrentFailsCreate()
 	CurrentFailsLoad()
+	CurrentFailsLink(hosts)
+	TaskSchedulesLoad(hosts)
 
 	if pidPath := ctx.String("pid-file"); pidPath != "" {
 		pid, err := NewPIDFile(pidPath)
@@ -276,10 +363,187 @@ func mainDefault(ctx *cli.Context) error {
 
 	heartbeatsSchedule(heartbeats, config.HeartbeatDelay)
 
-	if err := scheduleHosts(hosts, config); err != nil {
+	scheduleHosts(hosts, config)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			Info.Printf("%s received", sig)
+			break
+		}
+		Info.Print("SIGHUP received, reloading configuration…")
+		if err := reloadConfiguration(ctx); err != nil {
+			Error.Printf("configuration reload failed, keeping the current one: %s", err)
+		}
+	}
+
+	// a second signal will kill us the hard way
+	signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+	shutdown(GlobalConfigGet().ShutdownTimeout)
+
+	return nil
+}
+
+func mainReload(ctx *cli.Context) error {
+	LogInit(ctx.Parent())
+
+	pidPath := ctx.Parent().String("pid-file")
+	if pidPath == "" {
+		err := fmt.Errorf("Error, you must give the pid file of the running instance (--pid-file)")
 		return cli.NewExitError(err, 1)
 	}
 
+	if err := PIDFileSignal(pidPath, syscall.SIGHUP); err != nil {
+		return cli.NewExitError(fmt.Errorf("Error with pid file: %s", err), 100)
+	}
+	fmt.Println("Reload requested")
+	return nil
+}
+
+func mainTrust(ctx *cli.Context) error {
+	LogInit(ctx.Parent())
+
+	config, err := GlobalConfigRead(ctx.Parent().String("config-path"), "nosee.toml")
+	if err != nil {
+		Error.Printf("Config (nosee.toml): %s", err)
+		return cli.NewExitError("", 1)
+	}
+	config.loadDisabled = true
+	config.doConnTest = false
+	GlobalConfig = config
+
+	hosts, err := createHosts(ctx, config)
+	if err != nil {
+		Error.Println(err)
+		return cli.NewExitError("", 10)
+	}
+
+	requestedHost := ctx.Args().Get(0)
+	var foundHost *Host
+	for _, host := range hosts {
+		if host.Name == requestedHost || host.Filename == requestedHost {
+			foundHost = host
+			break
+		}
+	}
+	if foundHost == nil {
+		var list bytes.Buffer
+		for _, host := range hosts {
+			list.WriteString(fmt.Sprintf("- %s (%s)\n", host.Filename, host.Name))
+		}
+		Error.Printf("can't find '%s' host, you must give a host Name or hosts.d/ filename:\n%s", requestedHost, list.String())
+		return cli.NewExitError("", 1)
+	}
+
+	if foundHost.Connection == nil {
+		Error.Printf("host '%s' does not use SSH (%s transport), no host key to trust", foundHost.Name, foundHost.TransportName)
+		return cli.NewExitError("", 1)
+	}
+
+	// every address of the host (they may not share the same key)
+	keys := make(map[string]ssh.PublicKey)
+	var addresses []string
+	for _, address := range foundHost.Connection.Addresses() {
+		key, err := foundHost.Connection.FetchHostKey(address)
+		if err != nil {
+			Error.Printf("can't get host key of '%s' (%s): %s", foundHost.Name, address, err)
+			continue
+		}
+		fmt.Printf("Host key of '%s' (%s):\n%s %s\n", foundHost.Name, address, key.Type(), ssh.FingerprintSHA256(key))
+		keys[address] = key
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return cli.NewExitError("", 20)
+	}
+
+	if ctx.Bool("yes") == false {
+		if len(addresses) > 1 {
+			fmt.Printf("Trust and pin these keys? [y/N] ")
+		} else {
+			fmt.Printf("Trust and pin this key? [y/N] ")
+		}
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Aborted, nothing saved")
+			return cli.NewExitError("", 1)
+		}
+	}
+
+	for _, address := range addresses {
+		if err := HostKeyStorePin(address, keys[address]); err != nil {
+			Error.Printf("can't save host key: %s (see save_path param?)", err)
+			return cli.NewExitError("", 30)
+		}
+	}
+	fmt.Printf("Key(s) saved to '%s'\n", hostKeysPath())
+	return nil
+}
+
+func mainState(ctx *cli.Context) error {
+	LogInit(ctx.Parent())
+
+	config, err := GlobalConfigRead(ctx.Parent().String("config-path"), "nosee.toml")
+	if err != nil {
+		Error.Printf("Config (nosee.toml): %s", err)
+		return cli.NewExitError("", 1)
+	}
+	GlobalConfig = config
+
+	states, err := ProbeStatesList()
+	if err != nil {
+		Error.Printf("can't list states: %s (see save_path param?)", err)
+		return cli.NewExitError("", 10)
+	}
+
+	requestedHost := ctx.Args().Get(0)
+	requestedProbe := ctx.Args().Get(1)
+	var found []*ProbeState
+	for _, state := range states {
+		if requestedHost != "" && state.Host != requestedHost {
+			continue
+		}
+		if requestedProbe != "" && state.Probe != requestedProbe {
+			continue
+		}
+		found = append(found, state)
+	}
+
+	if len(found) == 0 {
+		fmt.Println("No state found")
+		return nil
+	}
+
+	for _, state := range found {
+		fmt.Printf("%s / %s: %d byte(s), saved %s\n", state.Host, state.Probe, len(state.State), state.Time.Format("2006-01-02 15:04:05"))
+		if requestedProbe != "" {
+			fmt.Println(state.State)
+		}
+	}
+
+	if ctx.Bool("reset") == false {
+		return nil
+	}
+
+	if ctx.Bool("yes") == false {
+		fmt.Printf("Reset %d state(s)? [y/N] ", len(found))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Aborted, nothing reset")
+			return cli.NewExitError("", 1)
+		}
+	}
+
+	for _, state := range found {
+		if err := ProbeStateDelete(state.Host, state.Probe); err != nil {
+			Error.Printf("can't reset state of '%s' (%s): %s", state.Probe, state.Host, err)
+			return cli.NewExitError("", 30)
+		}
+	}
+	fmt.Printf("%d state(s) reset\n", len(found))
 	return nil
 }
 
@@ -294,6 +558,7 @@ func mainCheck(ctx *cli.Context) error {
 		return cli.NewExitError("", 1)
 	}
 	GlobalConfig = config
+	globalRunQueue.SetLimits(config.MaxConcurrentRuns, config.MaxConcurrentRunsPerClass)
 
 	_, err = heartbeatsList(config)
 	if err != nil {
@@ -307,15 +572,29 @@ func mainCheck(ctx *cli.Context) error {
 		return cli.NewExitError("", 2)
 	}
 
-	_, err = createHosts(ctx, config)
+	hosts, err := createHosts(ctx, config)
 	if err != nil {
 		Error.Println(err)
 		return cli.NewExitError("", 10)
 	}
+
+	for _, host := range hosts {
+		if host.Connection != nil && host.Connection.Negotiated != nil {
+			fmt.Printf("%s: %s\n", host.Name, host.Connection.Negotiated)
+		}
+	}
 	fmt.Println("OK")
 	return nil
 }
 
+// printTaskDependencies prints the dependency tree of the task
+func printTaskDependencies(task *Task, indent string) {
+	for _, dep := range task.DependsOn {
+		fmt.Printf("%s- %s\n", indent, dep.Probe.Name)
+		printTaskDependencies(dep, indent+"  ")
+	}
+}
+
 func mainRecap(ctx *cli.Context) error {
 	LogInit(ctx.Parent())
 
@@ -339,6 +618,8 @@ func mainRecap(ctx *cli.Context) error {
 		return cli.NewExitError("", 10)
 	}
 
+	TaskSchedulesLoad(hosts)
+
 	if ctx.Bool("no-color") == true {
 		color.NoColor = true
 	}
@@ -350,8 +631,31 @@ func mainRecap(ctx *cli.Context) error {
 
 	for _, host := range hosts {
 		fmt.Printf("%s: %s\n", cyan("Host"), host.Name)
+		if host.TransportName != TransportSSH {
+			fmt.Printf("  %s: %s\n", cyan("Transport"), host.TransportName)
+		}
+		if host.Shell != ShellBash {
+			fmt.Printf("  %s: %s\n", cyan("Shell"), host.Shell)
+		}
+		if host.Connection != nil && len(host.Connection.Hosts) > 1 {
+			fmt.Printf("  %s: %s (%s)\n", cyan("Addresses"), strings.Join(host.Connection.Addresses(), ", "), host.Connection.HostsMode)
+		}
+		if len(host.Parents) > 0 {
+			fmt.Printf("  %s: %s\n", cyan("Parents"), strings.Join(host.Parents, ", "))
+		}
 		for _, task := range host.Tasks {
-			fmt.Printf("  %s: %s (%dm)\n", green("Probe"), task.Probe.Name, int(task.Probe.Delay.Minutes()))
+			delay := fmt.Sprintf("%dm", int(task.Probe.Delay.Minutes()))
+			if task.Probe.Delay%time.Minute != 0 {
+				delay = fmt.Sprintf("%ds", int(task.Probe.Delay.Seconds()))
+			}
+			if task.Probe.Schedule != nil {
+				delay = task.Probe.CronSpec
+			}
+			fmt.Printf("  %s: %s (%s, next run: %s)\n", green("Probe"), task.Probe.Name, delay, task.NextRun.Format("2006-01-02 15:04:05"))
+			if len(task.DependsOn) > 0 {
+				fmt.Printf("    %s (%s):\n", cyan("Depends on"), task.Probe.DependsMode)
+				printTaskDependencies(task, "      ")
+			}
 			for _, check := range task.Probe.Checks {
 				fmt.Printf("    %s: %s (%s)\n", yellow("Check"), check.Desc, strings.Join(check.Classes, ", "))
 				var msg AlertMessage
@@ -528,7 +832,7 @@ func mainTest(ctx *cli.Context) error {
 
 	result := run.TaskResults[0]
 
-	for key, val := range result.Values {
+	for key, val := range result.AllValues() {
 		fmt.Printf("value: %s = %s\n", yellow(key), yellow(val))
 	}
 
@@ -536,12 +840,18 @@ func mainTest(ctx *cli.Context) error {
 		fmt.Printf("log: %s\n", cyan(err))
 	}
 
-	if result.ExitStatus == 0 {
+	if result.stateSet == true {
+		fmt.Printf("state: %s (not saved by tests)\n", yellow(result.State))
+	}
+
+	if name, exists := nagiosStatusNames[result.ExitStatus]; exists == true && foundProbe.Output == OutputNagios {
+		fmt.Printf("script exit status: %s (Nagios %s)\n", yellow(result.ExitStatus), name)
+	} else if result.ExitStatus == 0 {
 		fmt.Printf("script exit status: %s (success)\n", green(result.ExitStatus))
 	} else {
 		fmt.Printf("script exit status: %s (error)\n", red(result.ExitStatus))
 	}
-	fmt.Printf("script duration: %s (+ ssh dial duration: %s)\n", result.Duration, run.DialDuration)
+	fmt.Printf("script duration: %s (+ ssh dial duration: %s, queue duration: %s)\n", result.Duration, run.DialDuration, run.QueueDuration)
 
 	if run.totalErrorCount() > 0 {
 		for _, err := range result.Errors {
@@ -558,10 +868,10 @@ func mainTest(ctx *cli.Context) error {
 	}
 
 	for _, check := range result.SuccessfulChecks {
-		fmt.Printf("check %s: %s: false (no alert)\n", green("GOOD"), green(check.Desc))
+		fmt.Printf("check %s: %s: false (no alert)\n", green("GOOD"), green(check.Desc()))
 	}
 	for _, check := range result.FailedChecks {
-		fmt.Printf("check %s: %s: true (alert)\n", red("BAD"), red(check.Desc))
+		fmt.Printf("check %s: %s: true (alert)\n", red("BAD"), red(check.Desc()))
 	}
 
 	return nil
@@ -631,6 +941,41 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:      "reload",
+			Usage:     "Reload configuration of the running instance (see --pid-file)",
+			ArgsUsage: " ",
+			Action:    mainReload,
+		},
+		{
+			Name:      "trust",
+			Usage:     "Fetch, show and pin the SSH host key of a Host",
+			ArgsUsage: "host",
+			Action:    mainTrust,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "pin the key without confirmation",
+				},
+			},
+		},
+		{
+			Name:        "state",
+			Usage:       "Show (or reset) states saved by probe scripts",
+			ArgsUsage:   "[host [probe]]",
+			Description: "use Names for host and probe, the state itself is shown when both are given",
+			Action:      mainState,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "reset",
+					Usage: "delete shown states",
+				},
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "reset without confirmation",
+				},
+			},
+		},
 		{
 			Name:      "expr",
 			Aliases:   []string{"e"},
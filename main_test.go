@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Trace = log.New(ioutil.Discard, "", 0)
+	Info = log.New(ioutil.Discard, "", 0)
+	Warning = log.New(ioutil.Discard, "", 0)
+	Error = log.New(ioutil.Discard, "", 0)
+	CheckFunctionsInit()
+	os.Exit(m.Run())
+}
+
+// testAlertsSetup creates empty current fails (saved in a temporary
+// directory) and an alert recording subjects of rung messages, returned
+// by the function (once every alert is rung)
+func testAlertsSetup(t *testing.T) func() []string {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "alerts")
+
+	globalsSet(&Config{SavePath: dir}, []*Alert{{
+		Name:      "test",
+		Targets:   []string{"*"},
+		Command:   "sh",
+		Arguments: []string{"-c", `printf '%s\n' "$SUBJECT" >> ` + file},
+	}}, nil)
+	CurrentFailsCreate()
+
+	return func() []string {
+		backgroundJobs.Wait()
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects := strings.Split(strings.TrimSpace(string(data)), "\n")
+		sort.Strings(subjects)
+		return subjects
+	}
+}
@@ -65,3 +65,23 @@ func pidIsRunning(pid int) bool {
 
 	return true
 }
+
+// PIDFileSignal sends a signal to the process of the given PID file
+func PIDFileSignal(path string, sig os.Signal) error {
+	pidByte, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidByte)))
+	if err != nil {
+		return fmt.Errorf("invalid pid file '%s': %s", path, err)
+	}
+	if !pidIsRunning(pid) {
+		return fmt.Errorf("no running process with pid %d (see '%s')", pid, path)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(sig)
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/Knetic/govaluate"
+	"github.com/robfig/cron/v3"
 )
 
 // Check holds final informations about a check of a probes.d file
@@ -11,24 +12,73 @@ type Check struct {
 	Index           int
 	Desc            string
 	If              *govaluate.EvaluableExpression
+	Type            string // type of script values (ValueAuto, ValueNumber, …)
 	Classes         []string
 	NeededFailures  int
 	NeededSuccesses int
+
+	// implicit checks (Nagios plugins) are skipped when their values are
+	// missing, and the value named TextValue (if any) is added to alerts
+	Implicit  bool
+	TextValue string
 }
 
 // Probe is the final form of probes.d files
 type Probe struct {
-	Name      string
-	Filename  string
-	Disabled  bool
-	Script    string
-	Targets   []string
-	Delay     time.Duration
-	Timeout   time.Duration
-	Arguments string
-	Defaults  map[string]interface{}
-	Checks    []*Check
-	RunIf     *govaluate.EvaluableExpression
+	Name        string
+	Filename    string
+	Disabled    bool
+	Script      string
+	Targets     []string
+	Delay       time.Duration
+	Schedule    cron.Schedule
+	CronSpec    string
+	Timeout     time.Duration
+	Arguments   string
+	Output      string // OutputLines, OutputJSON or OutputNagios
+	Defaults    map[string]interface{}
+	Checks      []*Check
+	RunIf       *govaluate.EvaluableExpression
+	DependsOn   []string
+	DependsMode string
+	Labelled    []string // values printed with a label, one per instance
+
+	confHash string
+}
+
+// Probe dependency modes: when a dependency is failing, a dependent
+// probe is not run at all (skip) or is run without ringing any
+// alert (suppress)
+const (
+	DependsSkip     = "skip"
+	DependsSuppress = "suppress"
+)
+
+// Probe script output formats
+const (
+	OutputLines  = "lines"  // KEY: value lines, # logs
+	OutputJSON   = "json"   // a single JSON document (see parseJSONOutput)
+	OutputNagios = "nagios" // a Nagios plugin (see parseNagiosOutput)
+)
+
+// NextRunAfter returns the next run time of the probe after the given
+// time, using the cron schedule or the delay
+func (probe *Probe) NextRunAfter(t time.Time) time.Time {
+	if probe.Schedule != nil {
+		return probe.Schedule.Next(t)
+	}
+	return t.Add(probe.Delay)
+}
+
+// IsLabelled returns true if the named script value is printed with a
+// label (NAME[label]), checks using it being evaluated per instance
+func (probe *Probe) IsLabelled(name string) bool {
+	for _, labelled := range probe.Labelled {
+		if labelled == name {
+			return true
+		}
+	}
+	return false
 }
 
 // MissingDefaults return a slice with names of defaults used in Check 'If'
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProbeState is the state saved by a probe script for a host, given back
+// to the next run of the script (see NOSEE_STATE)
+type ProbeState struct {
+	Host  string
+	Probe string
+	State string
+	Time  time.Time
+}
+
+// the state is an environment variable of the script, on the monitored
+// host: Linux limits each variable (with its name) to 128KB, other
+// systems only limit the whole environment and arguments (256KB or more)
+const stateMaxSizeLimit = 128*1024 - 2048
+
+const (
+	statesDir    string = "states"
+	stateEnvName        = "NOSEE_STATE"
+)
+
+func probeStatesPath() string {
+	return path.Clean(GlobalConfigGet().SavePath + "/" + statesDir)
+}
+
+func probeStatePath(hostName string, probeName string) string {
+	// with a separator, so host "ab" and probe "c" is not host "a" and probe "bc"
+	return path.Join(probeStatesPath(), MD5Hash(hostName+"\x00"+probeName)+".json")
+}
+
+// ProbeStateLoad returns the saved state of the probe for the named host
+// (an empty string if there's none)
+func ProbeStateLoad(hostName string, probeName string) string {
+	f, err := os.Open(probeStatePath(hostName, probeName))
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			Error.Printf("can't read state of '%s' (%s): %s", probeName, hostName, err)
+		}
+		return ""
+	}
+	defer f.Close()
+
+	var state ProbeState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		Error.Printf("state of '%s' (%s) json decode: %s", probeName, hostName, err)
+		return ""
+	}
+	return state.State
+}
+
+// ProbeStateSave saves the state of the probe for the named host (an empty
+// state deletes the saved one)
+func ProbeStateSave(hostName string, probeName string, value string) error {
+	if value == "" {
+		return ProbeStateDelete(hostName, probeName)
+	}
+
+	if err := os.MkdirAll(probeStatesPath(), 0700); err != nil {
+		return err
+	}
+	state := ProbeState{
+		Host:  hostName,
+		Probe: probeName,
+		State: value,
+		Time:  time.Now(),
+	}
+	return SaveJSONFile(probeStatePath(hostName, probeName), &state)
+}
+
+// ProbeStateDelete deletes the saved state of the probe for the named host
+func ProbeStateDelete(hostName string, probeName string) error {
+	err := os.Remove(probeStatePath(hostName, probeName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ProbeStatesList returns every saved state, sorted by host and probe
+func ProbeStatesList() ([]*ProbeState, error) {
+	entries, err := os.ReadDir(probeStatesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*ProbeState
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(probeStatesPath(), entry.Name()))
+		if err != nil {
+			Warning.Printf("can't read state: %s", err)
+			continue
+		}
+		var state ProbeState
+		if err := json.Unmarshal(data, &state); err != nil {
+			Warning.Printf("state '%s' json decode: %s", entry.Name(), err)
+			continue
+		}
+		states = append(states, &state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Host != states[j].Host {
+			return states[i].Host < states[j].Host
+		}
+		return states[i].Probe < states[j].Probe
+	})
+	return states, nil
+}
+
+// shellQuote returns str as a single-quoted shell word
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+// SaveStates saves states given by scripts of the run (unless the task
+// failed, so the next run starts again from the previous state)
+func (run *Run) SaveStates() {
+	for _, taskResult := range run.TaskResults {
+		if taskResult.stateSet == false {
+			continue
+		}
+		probeName := taskResult.Task.Probe.Name
+		if len(taskResult.Errors) > 0 {
+			Info.Printf("state of '%s' not saved, task failed (%s)", probeName, run.Host.Name)
+			continue
+		}
+		if err := ProbeStateSave(run.Host.Name, probeName, taskResult.State); err != nil {
+			Error.Printf("can't save state of '%s' (%s): %s (see save_path param?)", probeName, run.Host.Name, err)
+			continue
+		}
+		Trace.Printf("state of '%s' saved (%s, %d bytes)", probeName, run.Host.Name, len(taskResult.State))
+	}
+}
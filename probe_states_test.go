@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestProbeStatePath(t *testing.T) {
+	globalsSet(&Config{SavePath: t.TempDir()}, nil, nil)
+
+	if probeStatePath("ab", "c") == probeStatePath("a", "bc") {
+		t.Errorf("host 'ab', probe 'c' and host 'a', probe 'bc' share the same state")
+	}
+	if probeStatePath("a", "b") != probeStatePath("a", "b") {
+		t.Errorf("state path is not stable")
+	}
+}
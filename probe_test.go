@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeNextRunAfter(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	// a Friday
+	from := time.Date(2024, 3, 15, 10, 20, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)},
+		{"20 10 * * *", time.Date(2024, 3, 16, 10, 20, 0, 0, time.UTC)},
+		{"15 6 * * 1-5", time.Date(2024, 3, 18, 6, 15, 0, 0, time.UTC)},
+		{"45 * * * * *", time.Date(2024, 3, 15, 10, 20, 45, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=Europe/Paris 0 30 6 * * *", time.Date(2024, 3, 16, 6, 30, 0, 0, paris)},
+		// Paris switches to summer time on 2024-03-31 (UTC+1 to UTC+2)
+		{"CRON_TZ=Europe/Paris 0 12 31 3 *", time.Date(2024, 3, 31, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := cronParser.Parse(test.spec)
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		probe := &Probe{Schedule: schedule, CronSpec: test.spec}
+		if got := probe.NextRunAfter(from); got.Equal(test.want) == false {
+			t.Errorf("%s: next run is %s, want %s", test.spec, got, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * *", "61 * * * *", "* * * * * * *", "@often"} {
+		if _, err := cronParser.Parse(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+
+	probe := &Probe{Delay: 5 * time.Minute}
+	if got, want := probe.NextRunAfter(from), from.Add(5*time.Minute); got.Equal(want) == false {
+		t.Errorf("delay: next run is %s, want %s", got, want)
+	}
+}
+
+func TestTaskPostpone(t *testing.T) {
+	from := time.Date(2024, 3, 15, 10, 20, 30, 0, time.UTC)
+	schedule, err := cronParser.Parse("0 12 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		probe *Probe
+		want  time.Time
+	}{
+		{&Probe{Schedule: schedule}, time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)},
+		{&Probe{Delay: 30 * time.Second}, from.Add(30 * time.Second)},
+		{&Probe{Delay: time.Hour}, from.Add(RetryDelay)},
+	}
+
+	for num, test := range tests {
+		task := &Task{Probe: test.probe}
+		task.Postpone(from)
+		if task.NextRun.Equal(test.want) == false {
+			t.Errorf("#%d: next run is %s, want %s", num, task.NextRun, test.want)
+		}
+	}
+}
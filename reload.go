@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/urfave/cli"
+)
+
+// globalsMutex protects GlobalConfig, globalAlerts and globalLogers,
+// replaced on reload while hosts are running (they're set without it
+// only during startup, before any host is scheduled)
+var globalsMutex sync.RWMutex
+
+// GlobalConfigGet returns the current Nosee server configuration
+func GlobalConfigGet() *Config {
+	globalsMutex.RLock()
+	defer globalsMutex.RUnlock()
+	return GlobalConfig
+}
+
+func globalAlertsGet() []*Alert {
+	globalsMutex.RLock()
+	defer globalsMutex.RUnlock()
+	return globalAlerts
+}
+
+func globalLogersGet() []string {
+	globalsMutex.RLock()
+	defer globalsMutex.RUnlock()
+	return globalLogers
+}
+
+func globalsSet(config *Config, alerts []*Alert, loggers []string) {
+	globalsMutex.Lock()
+	defer globalsMutex.Unlock()
+	GlobalConfig = config
+	globalAlerts = alerts
+	globalLogers = loggers
+}
+
+// reloadConfiguration reads the whole configuration again and applies
+// it to scheduled hosts: new hosts are started, removed ones are stopped
+// and modified ones are restarted, keeping schedules of unchanged tasks
+// and matching current fails. Nothing is changed if the new
+// configuration is invalid.
+func reloadConfiguration(ctx *cli.Context) error {
+	config, err := GlobalConfigRead(ctx.String("config-path"), "nosee.toml")
+	if err != nil {
+		return fmt.Errorf("Config (nosee.toml): %s", err)
+	}
+	// we will only test new and modified hosts, see below
+	config.doConnTest = false
+
+	loggers, err := loggersList(config)
+	if err != nil {
+		return err
+	}
+
+	hosts, alerts, err := loadHosts(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	oldHosts := scheduledHostsList()
+
+	var changed []*Host
+	for i, host := range hosts {
+		oldHost, exists := oldHosts[host.Name]
+		if exists == true && host.SameAs(oldHost) {
+			hosts[i] = oldHost
+			continue
+		}
+		changed = append(changed, host)
+	}
+
+	if len(changed) > 0 {
+		if err := testHostsConnections(changed); err != nil {
+			return err
+		}
+	}
+
+	// the new configuration is valid, let's apply it
+	globalsSet(config, alerts, loggers)
+	globalRunQueue.SetLimits(config.MaxConcurrentRuns, config.MaxConcurrentRunsPerClass)
+
+	remapHosts := make(map[*Host]*Host)
+	remapTasks := make(map[*Task]*Task)
+	checkHashes := make(map[string]bool)
+
+	kept := make(map[string]bool)
+	for _, host := range hosts {
+		kept[host.Name] = true
+	}
+	for name, oldHost := range oldHosts {
+		if kept[name] == false {
+			Info.Printf("reload: removing host '%s'", name)
+			unscheduleHost(name)
+			TaskSchedulesForget(name)
+			// fails without Related* payloads (or loaded from disk)
+			for _, hash := range hostFailHashes(name) {
+				if cf := CurrentFailGet(hash); cf != nil {
+					Info.Printf("deleting fail '%s' (host removed)", cf.UniqueID)
+					CurrentFailDelete(hash)
+				}
+			}
+			remapHosts[oldHost] = nil
+			for _, oldTask := range oldHost.Tasks {
+				remapTasks[oldTask] = nil
+			}
+		}
+	}
+
+	for _, host := range changed {
+		oldHost, exists := oldHosts[host.Name]
+		if exists == false {
+			Info.Printf("reload: adding host '%s'", host.Name)
+			continue
+		}
+
+		Info.Printf("reload: restarting modified host '%s'", host.Name)
+		unscheduleHost(host.Name)
+		remapHosts[oldHost] = host
+
+		for _, oldTask := range oldHost.Tasks {
+			remapTasks[oldTask] = nil
+			for _, task := range host.Tasks {
+				if task.Probe.Name != oldTask.Probe.Name {
+					continue
+				}
+				remapTasks[oldTask] = task
+				if task.Probe.confHash == oldTask.Probe.confHash {
+					task.PrevRun = oldTask.PrevRun
+					task.NextRun = oldTask.NextRun
+				}
+			}
+		}
+
+		for _, task := range host.Tasks {
+			for _, check := range task.Probe.Checks {
+				checkHashes[checkFailHash(host.Name, task.Probe.Name, check, "")] = true
+			}
+		}
+	}
+
+	CurrentFailsRemap(remapHosts, remapTasks, checkHashes)
+
+	for _, host := range changed {
+		scheduleHost(host, 0)
+	}
+
+	Info.Printf("configuration reloaded (%d host(s) added or modified, %d host(s) total)", len(changed), len(hosts))
+	return nil
+}
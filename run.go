@@ -2,18 +2,30 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// SSHDialMsValue is a built-in value, available to every check: the
+// SSH connection duration of the run, in milliseconds (SSH transport only)
+const SSHDialMsValue = "SSH_DIAL_MS"
+
 // Run is a list of Tasks on Host, including task results
 type Run struct {
-	Host         *Host
-	Tasks        []*Task
-	StartTime    time.Time
-	Duration     time.Duration
-	DialDuration time.Duration
-	TaskResults  []*TaskResult
-	Errors       []error
+	Host          *Host
+	Tasks         []*Task
+	StartTime     time.Time
+	Duration      time.Duration
+	QueueDuration time.Duration
+	DialDuration  time.Duration
+	Address       string
+	DialTimings   SSHDialTimings
+	TaskResults   []*TaskResult
+	Errors        []error
+
+	abort   chan struct{}
+	streams sync.WaitGroup
 }
 
 // Dump prints Run informations on the screen for debugging purposes
@@ -23,7 +35,10 @@ func (run *Run) Dump() {
 	fmt.Printf("- %d task(s)\n", len(run.Tasks))
 	fmt.Printf("- start: %s\n", run.StartTime)
 	fmt.Printf("- duration: %s\n", run.Duration)
+	fmt.Printf("- queue duration: %s\n", run.QueueDuration)
 	fmt.Printf("- ssh dial duration: %s\n", run.DialDuration)
+	fmt.Printf("- address: %s\n", run.Address)
+	fmt.Printf("- ssh dial timings: %s\n", &run.DialTimings)
 	for _, err := range run.Errors {
 		fmt.Printf("-e %s\n", err)
 	}
@@ -33,14 +48,14 @@ func (run *Run) Dump() {
 		fmt.Printf("-- duration: %s\n", res.Duration)
 		fmt.Printf("-- exit status: %d\n", res.ExitStatus)
 		fmt.Printf("-- next task run: %s\n", res.Task.NextRun)
-		for key, val := range res.Values {
+		for key, val := range res.AllValues() {
 			fmt.Printf("-v- '%s' = '%s'\n", key, val)
 		}
 		for _, err := range res.Errors {
 			fmt.Printf("-e- %s\n", err)
 		}
 		for _, check := range res.FailedChecks {
-			fmt.Printf("-F- %s\n", check.Desc)
+			fmt.Printf("-F- %s\n", check.Desc())
 		}
 		for _, log := range res.Logs {
 			fmt.Printf("-l- %s\n", log)
@@ -77,20 +92,20 @@ func (run *Run) totalTaskResultErrorCount() int {
 	return total
 }
 
-// ReSchedule will force all Run tasks to run on next time step
+// ReSchedule will force all Run tasks to run again soon (see Task.Retry)
 func (run *Run) ReSchedule() {
 	for _, task := range run.Tasks {
-		task.NextRun = task.PrevRun
+		task.Retry(time.Now())
 	}
 	Info.Printf("re-scheduling all tasks for '%s'\n", run.Host.Name)
 }
 
-// ReScheduleFailedTasks will force all Run failed tasks to run on next time step
+// ReScheduleFailedTasks will force all Run failed tasks to run again soon
 func (run *Run) ReScheduleFailedTasks() {
 	for _, task := range run.Tasks {
 		for _, cf := range currentFails {
 			if cf.RelatedTask == task || cf.RelatedTTask == task {
-				task.ReSchedule(time.Now())
+				task.Retry(time.Now())
 				Info.Printf("re-scheduling task '%s'\n", task.Probe.Name)
 			}
 		}
@@ -106,9 +121,15 @@ func (run *Run) DoChecks() {
 
 // Go will execute the Run
 func (run *Run) Go() {
-	const bootstrap = "bash -s --"
+	bootstrap := shellBootstrap(run.Host.Shell)
+
+	queueStart := time.Now()
+	release := globalRunQueue.Acquire(run.Host)
+	defer release()
+	run.QueueDuration = time.Now().Sub(queueStart)
+	Trace.Printf("run queued for %s (%s)", run.QueueDuration, run.Host.Name)
 
-	timeout := time.Second * 59
+	timeout := run.Host.RunTimeout
 	timeoutChan := time.After(timeout)
 
 	run.StartTime = time.Now()
@@ -116,18 +137,28 @@ func (run *Run) Go() {
 		run.Duration = time.Now().Sub(run.StartTime)
 	}()
 
-	if err := run.Host.Connection.Connect(); err != nil {
+	transport := run.Host.Transport
+	err := transport.Connect()
+	run.DialDuration = time.Now().Sub(run.StartTime)
+	conn := run.Host.Connection
+	if conn != nil {
+		run.DialTimings = conn.Timings()
+	}
+	if err != nil {
 		run.addError(err)
 		return
 	}
-	defer run.Host.Connection.Close()
+	defer transport.Close()
 
-	run.DialDuration = time.Now().Sub(run.StartTime)
-	if run.DialDuration > run.Host.Connection.SSHConnTimeWarn {
-		run.addError(fmt.Errorf("SSH connection time was too long: %s (ssh_connection_time_warn = %s)", run.DialDuration, run.Host.Connection.SSHConnTimeWarn))
-		return
+	if conn != nil {
+		run.Address = conn.AnsweredAddress()
+		// a slow connection is not a run error, see AlertsForDial
+		if run.DialDuration > conn.SSHConnTimeWarn {
+			Info.Printf("SSH connection time was too long: %s (ssh_connection_time_warn = %s, %s, host '%s')", run.DialDuration, conn.SSHConnTimeWarn, &run.DialTimings, run.Host.Name)
+		}
 	}
 
+	run.abort = make(chan struct{})
 	if err := run.preparePipes(); err != nil {
 		run.addError(err)
 		return
@@ -136,7 +167,7 @@ func (run *Run) Go() {
 	ended := make(chan int, 1)
 
 	go func() {
-		if err := run.Host.Connection.Session.Run(bootstrap); err != nil {
+		if err := transport.Run(bootstrap); err != nil {
 			run.addError(err)
 		}
 		ended <- 1
@@ -145,8 +176,35 @@ func (run *Run) Go() {
 	select {
 	case <-ended:
 		// nice
+		transport.Close()
+	case <-run.abort:
+		Trace.Println("run aborted")
+		transport.Disconnect()
 	case <-timeoutChan:
 		run.addError(fmt.Errorf("timeout for this run, after %s", timeout))
 		Trace.Println("run timeout")
+		transport.Disconnect()
+	}
+
+	// the connection is now closed, so any remaining stream goroutine is unblocked
+	run.streams.Wait()
+
+	run.addBuiltinValues()
+}
+
+// addBuiltinValues adds values measured by Nosee itself to every
+// TaskResult, so checks can use them like any script value
+func (run *Run) addBuiltinValues() {
+	if run.Host.Connection == nil {
+		return
+	}
+	dialMs := strconv.FormatInt(int64(run.DialDuration/time.Millisecond), 10)
+	for _, taskResult := range run.TaskResults {
+		_, exists := taskResult.Values[SSHDialMsValue]
+		if _, structured := taskResult.Structured[SSHDialMsValue]; exists || structured || taskResult.isLabelled(SSHDialMsValue) {
+			taskResult.addError(fmt.Errorf("parameter '%s' is a built-in value, it can't be defined by a script", SSHDialMsValue))
+			continue
+		}
+		taskResult.Values[SSHDialMsValue] = dialMs
 	}
 }
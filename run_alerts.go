@@ -5,11 +5,10 @@ import (
 	"strconv"
 )
 
-// AlertsForRun creates a currentFail entry for this Run (if not already done)
-// and rings corresponding alerts
-func (run *Run) AlertsForRun() {
+// runFailHash returns the currentFail hash of run failures for the named host
+func runFailHash(hostName string) string {
 	var bbuf bytes.Buffer
-	bbuf.WriteString(run.Host.Name)
+	bbuf.WriteString(hostName)
 	// We now limit to one Fail per host, otherwise we may flood
 	// the user with Errors (ex: "alert, ssh connection 11s", then the same
 	// with 11.5s, etc). If there's an issue with a host, you have to fix it
@@ -17,22 +16,119 @@ func (run *Run) AlertsForRun() {
 	/*for _, err := range run.Errors {
 		bbuf.WriteString(err.Error())
 	}*/
-	hash := MD5Hash(bbuf.String())
+	return MD5Hash(bbuf.String())
+}
+
+// dialFailHash returns the currentFail hash of slow SSH connections for
+// the named host
+func dialFailHash(hostName string) string {
+	return MD5Hash(hostName + SSHDialMsValue)
+}
+
+// fallbackFailHash returns the currentFail hash of the use of a fallback
+// address (the primary one being down) for the named host
+func fallbackFailHash(hostName string) string {
+	return MD5Hash(hostName + "fallback address")
+}
+
+// hostFailHashes returns currentFail hashes of the named host itself (not
+// of its tasks or checks)
+func hostFailHashes(hostName string) []string {
+	return []string{runFailHash(hostName), dialFailHash(hostName), fallbackFailHash(hostName)}
+}
+
+// checkFailHash returns the currentFail hash of the check of a probe for
+// the named host, and of one of its instances if label is not empty
+func checkFailHash(hostName string, probeName string, check *Check, label string) string {
+	hash := MD5Hash(hostName + probeName + strconv.Itoa(check.Index))
+	if label == "" {
+		return hash
+	}
+	return MD5Hash(hash + "[" + label + "]")
+}
+
+// AlertsForDial tracks slow SSH connections (longer than
+// ssh_connection_time_warn) and rings corresponding alerts once
+// ssh_connection_time_needed_failures is reached, as for a check. The
+// same count of normal connections is needed for the GOOD alert (there's
+// no needed successes setting).
+func (run *Run) AlertsForDial() {
+	conn := run.Host.Connection
+	if conn == nil || run.Address == "" {
+		return // not connected, nothing measured
+	}
+
+	hash := dialFailHash(run.Host.Name)
+
+	if run.DialDuration > conn.SSHConnTimeWarn {
+		currentFail := CurrentFailGetAndInc(hash)
+		currentFail.Host = run.Host.Name
+		if currentFail.FailCount != conn.SSHConnTimeNeededFailures {
+			return // not yet, or already sent
+		}
+		message := AlertMessageCreateForDial(AlertBad, run, currentFail)
+		message.RingAlerts()
+		return
+	}
+
+	if currentFail := CurrentFailGetAndDec(hash); currentFail != nil {
+		if currentFail.OkCount >= conn.SSHConnTimeNeededFailures {
+			Info.Printf("SSH connection time is OK again (%s)\n", run.Host.Name)
+			if currentFail.FailCount >= conn.SSHConnTimeNeededFailures {
+				message := AlertMessageCreateForDial(AlertGood, run, currentFail)
+				message.RingAlerts()
+			}
+			CurrentFailDelete(hash)
+		}
+	}
+}
+
+// AlertsForRun creates a currentFail entry for this Run (if not already done)
+// and rings corresponding alerts. If a parent of the host is down, the
+// alert is replaced by an "unreachable" notice.
+func (run *Run) AlertsForRun() {
+	hash := runFailHash(run.Host.Name)
 
 	currentFail := CurrentFailGetAndInc(hash)
 	currentFail.RelatedHost = run.Host
+	currentFail.Host = run.Host.Name
 
-	if currentFail.FailCount > 1 {
+	if parent := run.Host.DownParent(); parent != "" {
+		if currentFail.HeldBackBy == parent {
+			return
+		}
+		currentFail.HeldBackBy = parent
+		message := AlertMessageCreateForUnreachable(run, parent, currentFail)
+		message.RingAlerts()
 		return
 	}
 
+	// already sent, unless it was held back because of a parent
+	if currentFail.FailCount > 1 && currentFail.HeldBackBy == "" {
+		return
+	}
+	currentFail.HeldBackBy = ""
+
 	message := AlertMessageCreateForRun(AlertBad, run, currentFail)
 	message.RingAlerts()
 }
 
+// suppressingDependency returns the name of the failing dependency of the
+// task, if any, when its alerts are suppressed (depends_mode "suppress",
+// with "skip" the task is not run at all)
+func (run *Run) suppressingDependency(task *Task) string {
+	if task.Probe.DependsMode != DependsSuppress {
+		return ""
+	}
+	return task.FailingDependency(run.Host.Name)
+}
+
 // AlertsForTasks creates currentFail entries for each failed TaskResults
 // (if not already done) and rings corresponding alerts
 func (run *Run) AlertsForTasks() {
+	// all fails are recorded first, so dependencies between tasks
+	// of this run are known below
+	fails := make(map[*TaskResult]*CurrentFail)
 	for _, taskRes := range run.TaskResults {
 		if len(taskRes.Errors) > 0 {
 			var bbuf bytes.Buffer
@@ -44,47 +140,104 @@ func (run *Run) AlertsForTasks() {
 
 			currentFail := CurrentFailGetAndInc(hash)
 			currentFail.RelatedTTask = taskRes.Task
-			if currentFail.FailCount > 1 {
-				return
-			}
+			currentFail.Host = run.Host.Name
+			currentFail.Probe = taskRes.Task.Probe.Name
+			fails[taskRes] = currentFail
+		}
+	}
 
-			message := AlertMessageCreateForTaskResult(AlertBad, run, taskRes, currentFail)
-			message.RingAlerts()
+	for _, taskRes := range run.TaskResults {
+		currentFail, exists := fails[taskRes]
+		if exists == false {
+			continue
+		}
+
+		if parent := run.Host.DownParent(); parent != "" {
+			Info.Printf("task '%s' alert held back, parent '%s' is down (%s)\n", taskRes.Task.Probe.Name, parent, run.Host.Name)
+			currentFail.HeldBackBy = parent
+			continue
 		}
+
+		if dep := run.suppressingDependency(taskRes.Task); dep != "" {
+			Info.Printf("task '%s' alert suppressed, depends on failing '%s' (%s)\n", taskRes.Task.Probe.Name, dep, run.Host.Name)
+			currentFail.HeldBackBy = dep
+			continue
+		}
+
+		// already sent, unless it was held back
+		if currentFail.FailCount > 1 && currentFail.HeldBackBy == "" {
+			continue
+		}
+		currentFail.HeldBackBy = ""
+
+		message := AlertMessageCreateForTaskResult(AlertBad, run, taskRes, currentFail)
+		message.RingAlerts()
 	}
 }
 
 // AlertsForChecks creates currentFail entries for every FailedChecks of
-// every TaskResults (if not already done) and rings corresponding alerts
+// every TaskResults (if not already done) and rings corresponding alerts.
+// Each instance of a per-instance check has its own currentFail.
 func (run *Run) AlertsForChecks() {
-	// Failures
+	// Failures (all recorded first, see AlertsForTasks)
+	fails := make(map[*CheckResult]*CurrentFail)
 	for _, taskRes := range run.TaskResults {
-		for _, check := range taskRes.FailedChecks {
-			Info.Printf("task '%s', check '%s' failed (%s)\n", taskRes.Task.Probe.Name, check.Desc, run.Host.Name)
+		for _, checkRes := range taskRes.FailedChecks {
+			Info.Printf("task '%s', check '%s' failed (%s)\n", taskRes.Task.Probe.Name, checkRes.Desc(), run.Host.Name)
 
-			hash := MD5Hash(run.Host.Name + taskRes.Task.Probe.Name + strconv.Itoa(check.Index))
+			hash := checkFailHash(run.Host.Name, taskRes.Task.Probe.Name, checkRes.Check, checkRes.Label)
 			currentFail := CurrentFailGetAndInc(hash)
 			currentFail.RelatedTask = taskRes.Task
-			if currentFail.FailCount != check.NeededFailures {
-				continue // not yet / already done
+			currentFail.Host = run.Host.Name
+			currentFail.Probe = taskRes.Task.Probe.Name
+			currentFail.Label = checkRes.Label
+			currentFail.CheckHash = checkFailHash(run.Host.Name, taskRes.Task.Probe.Name, checkRes.Check, "")
+			fails[checkRes] = currentFail
+		}
+	}
+
+	for _, taskRes := range run.TaskResults {
+		for _, checkRes := range taskRes.FailedChecks {
+			check := checkRes.Check
+			currentFail := fails[checkRes]
+			if currentFail.FailCount < check.NeededFailures {
+				continue // not yet
+			}
+
+			if dep := run.suppressingDependency(taskRes.Task); dep != "" {
+				Info.Printf("task '%s', check '%s' alert suppressed, depends on failing '%s' (%s)\n", taskRes.Task.Probe.Name, checkRes.Desc(), dep, run.Host.Name)
+				currentFail.HeldBackBy = dep
+				continue
+			}
+
+			// already done, unless it was held back
+			if currentFail.FailCount > check.NeededFailures && currentFail.HeldBackBy == "" {
+				continue
 			}
+			currentFail.HeldBackBy = ""
 
-			message := AlertMessageCreateForCheck(AlertBad, run, taskRes, check, currentFail)
+			message := AlertMessageCreateForCheck(AlertBad, run, taskRes, checkRes, currentFail)
 			message.RingAlerts()
 		}
 	}
 
-	// Successes
+	// Successes (instances no longer reported by the script are OK too)
 	for _, taskRes := range run.TaskResults {
-		for _, check := range taskRes.SuccessfulChecks {
-			hash := MD5Hash(run.Host.Name + taskRes.Task.Probe.Name + strconv.Itoa(check.Index))
+		successes := append([]*CheckResult{}, taskRes.SuccessfulChecks...)
+		for _, check := range taskRes.Task.Probe.Checks {
+			successes = append(successes, taskRes.goneInstances(run.Host.Name, check)...)
+		}
+
+		for _, checkRes := range successes {
+			check := checkRes.Check
+			hash := checkFailHash(run.Host.Name, taskRes.Task.Probe.Name, check, checkRes.Label)
 			// we had a failure for that?
 			if currentFail := CurrentFailGetAndDec(hash); currentFail != nil {
 				if currentFail.OkCount == check.NeededSuccesses {
-					Info.Printf("task '%s', check '%s' is now OK (%s)\n", taskRes.Task.Probe.Name, check.Desc, run.Host.Name)
+					Info.Printf("task '%s', check '%s' is now OK (%s)\n", taskRes.Task.Probe.Name, checkRes.Desc(), run.Host.Name)
 					// send the good news (if the bad one was sent) and delete this currentFail
-					if currentFail.FailCount >= check.NeededFailures {
-						message := AlertMessageCreateForCheck(AlertGood, run, taskRes, check, currentFail)
+					if currentFail.FailCount >= check.NeededFailures && currentFail.HeldBackBy == "" {
+						message := AlertMessageCreateForCheck(AlertGood, run, taskRes, checkRes, currentFail)
 						message.RingAlerts()
 					}
 					CurrentFailDelete(hash)
@@ -97,6 +250,7 @@ func (run *Run) AlertsForChecks() {
 // Alerts checks for Run failures, Task failures and Check
 // failures and call corresponding AlertsFor*() functions
 func (run *Run) Alerts() {
+	run.AlertsForDial()
 	run.ClearAnyCurrentTasksFails()
 
 	if run.totalErrorCount() == 0 {
@@ -126,13 +280,16 @@ func (run *Run) Alerts() {
 // ClearAnyCurrentRunFails deletes any currentFail for the Run (same Host)
 // and then rings GOOD alerts
 func (run *Run) ClearAnyCurrentRunFails() {
+	runHash := runFailHash(run.Host.Name)
 	for hash, cf := range currentFails {
-		if cf.RelatedHost == run.Host {
+		if cf.RelatedHost == run.Host || hash == runHash {
 			// there was a time when we were only ringing one message
 			// for the whole host, but it's compliant with UniqueID idea
 			message := AlertMessageCreateForRun(AlertGood, run, cf)
 			message.RingAlerts()
 			CurrentFailDelete(hash)
+			// hosts behind this one are probably reachable again
+			wakeChildHosts(run.Host.Name)
 		}
 	}
 }
@@ -144,8 +301,11 @@ func (run *Run) ClearAnyCurrentTasksFails() {
 		if len(taskRes.Errors) == 0 {
 			for hash, cf := range currentFails {
 				if taskRes.Task == cf.RelatedTTask {
-					message := AlertMessageCreateForTaskResult(AlertGood, run, taskRes, cf)
-					message.RingAlerts()
+					// no good news if the bad one was held back
+					if cf.HeldBackBy == "" {
+						message := AlertMessageCreateForTaskResult(AlertGood, run, taskRes, cf)
+						message.RingAlerts()
+					}
 					CurrentFailDelete(hash)
 				}
 			}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+// testDependentRun returns a run of probes "base" and "dep", the latter
+// depending on the former with the given mode
+func testDependentRun(mode string) *Run {
+	expr, _ := govaluate.NewEvaluableExpression("A > 1")
+	check := &Check{Desc: "A > 1", If: expr, NeededFailures: 1, NeededSuccesses: 1}
+	host := &Host{Name: "h"}
+	base := &Task{Probe: &Probe{Name: "base"}}
+	dep := &Task{
+		Probe:     &Probe{Name: "dep", Checks: []*Check{check}, DependsMode: mode},
+		DependsOn: []*Task{base},
+	}
+	host.Tasks = []*Task{base, dep}
+
+	run := &Run{Host: host, Tasks: host.Tasks}
+	for _, task := range host.Tasks {
+		run.TaskResults = append(run.TaskResults, &TaskResult{Task: task, Host: host})
+	}
+	return run
+}
+
+func TestAlertsForTasks(t *testing.T) {
+	subjects := testAlertsSetup(t)
+
+	run := testDependentRun(DependsSkip)
+	for _, taskRes := range run.TaskResults {
+		taskRes.Errors = []error{errors.New("exit status 1")}
+	}
+	run.Tasks[1].DependsOn = nil
+
+	// the first task already alerted, not the second one
+	run.TaskResults = run.TaskResults[:1]
+	run.AlertsForTasks()
+	run.TaskResults = append(run.TaskResults, &TaskResult{Task: run.Tasks[1], Host: run.Host, Errors: []error{errors.New("exit status 1")}})
+	run.AlertsForTasks()
+
+	want := []string{
+		"[BAD] h: base: task error(s)",
+		"[BAD] h: dep: task error(s)",
+	}
+	if got := subjects(); reflect.DeepEqual(got, want) == false {
+		t.Errorf("alerts = %q, want %q", got, want)
+	}
+}
+
+func TestAlertsForChecksDependency(t *testing.T) {
+	tests := []struct {
+		mode   string
+		failed bool // base task is failing
+		alerts []string
+		held   string
+	}{
+		{DependsSkip, false, []string{"[BAD] h: A > 1 (dep)"}, ""},
+		{DependsSuppress, false, []string{"[BAD] h: A > 1 (dep)"}, ""},
+		// in skip mode, a task run before its dependency started failing
+		// still rings its alerts
+		{DependsSkip, true, []string{"[BAD] h: A > 1 (dep)"}, ""},
+		{DependsSuppress, true, nil, "base"},
+	}
+
+	for _, test := range tests {
+		subjects := testAlertsSetup(t)
+
+		run := testDependentRun(test.mode)
+		if test.failed {
+			CurrentFailAdd("base fail", &CurrentFail{FailCount: 1, RelatedTTask: run.Tasks[0]})
+		}
+		depRes := run.TaskResults[1]
+		depRes.FailedChecks = []*CheckResult{{Check: depRes.Task.Probe.Checks[0]}}
+
+		if dep := run.suppressingDependency(depRes.Task); dep != test.held {
+			t.Errorf("%s mode (failed: %t): suppressingDependency = %q, want %q", test.mode, test.failed, dep, test.held)
+		}
+
+		run.AlertsForChecks()
+		if got := subjects(); reflect.DeepEqual(got, test.alerts) == false {
+			t.Errorf("%s mode (failed: %t): alerts = %q, want %q", test.mode, test.failed, got, test.alerts)
+		}
+
+		hash := checkFailHash("h", "dep", depRes.Task.Probe.Checks[0], "")
+		if cf := CurrentFailGet(hash); cf == nil || cf.HeldBackBy != test.held {
+			t.Errorf("%s mode (failed: %t): check fail = %+v, want HeldBackBy %q", test.mode, test.failed, cf, test.held)
+		}
+	}
+}
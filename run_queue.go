@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+)
+
+// runQueueWaiter is a Host waiting for its turn in the runQueue
+type runQueueWaiter struct {
+	classes []string
+	ready   chan struct{}
+}
+
+// runQueue limits the number of concurrent runs, globally and per
+// host class. Waiting runs are served in a fair (FIFO) order: a run can
+// only pass another one if this one is blocked by a class limit.
+type runQueue struct {
+	mutex        sync.Mutex
+	maxRuns      int
+	maxClass     map[string]int
+	running      int
+	runningClass map[string]int
+	waiters      []*runQueueWaiter
+}
+
+// globalRunQueue is the queue used by every Run (no limit by default)
+var globalRunQueue = &runQueue{
+	maxClass:     make(map[string]int),
+	runningClass: make(map[string]int),
+}
+
+// SetLimits changes queue limits (0 means no limit), waiting runs
+// are dispatched again using these new limits
+func (queue *runQueue) SetLimits(maxRuns int, maxClass map[string]int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.maxRuns = maxRuns
+	queue.maxClass = make(map[string]int)
+	for class, max := range maxClass {
+		queue.maxClass[class] = max
+	}
+	queue.dispatch()
+}
+
+// limitedClasses returns host's classes with a concurrency limit
+func (queue *runQueue) limitedClasses(host *Host) []string {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var classes []string
+	for _, class := range host.Classes {
+		if _, exists := queue.maxClass[class]; exists == true {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+func (queue *runQueue) classesAvailable(classes []string) bool {
+	for _, class := range classes {
+		if max := queue.maxClass[class]; max > 0 && queue.runningClass[class] >= max {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatch wakes up waiting runs, in order, as long as limits allow
+// it (the mutex must be held by the caller)
+func (queue *runQueue) dispatch() {
+	for i := 0; i < len(queue.waiters); {
+		if queue.maxRuns > 0 && queue.running >= queue.maxRuns {
+			return
+		}
+
+		waiter := queue.waiters[i]
+		if queue.classesAvailable(waiter.classes) == false {
+			i++
+			continue
+		}
+
+		queue.running++
+		for _, class := range waiter.classes {
+			queue.runningClass[class]++
+		}
+		queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+		close(waiter.ready)
+	}
+}
+
+// Acquire waits for the host turn to run, and returns a function to
+// call when the run is over
+func (queue *runQueue) Acquire(host *Host) func() {
+	waiter := &runQueueWaiter{
+		classes: queue.limitedClasses(host),
+		ready:   make(chan struct{}),
+	}
+
+	queue.mutex.Lock()
+	queue.waiters = append(queue.waiters, waiter)
+	queue.dispatch()
+	queue.mutex.Unlock()
+
+	<-waiter.ready
+
+	return func() {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+
+		queue.running--
+		for _, class := range waiter.classes {
+			queue.runningClass[class]--
+		}
+		queue.dispatch()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testQueueRun is a run started by the queue, with its release function
+type testQueueRun struct {
+	num     int
+	release func()
+}
+
+// testQueueOrder queues a run for every host (given as its classes),
+// in order, then ends the oldest started run until all of them are
+// done, and returns the start order. Runs started at the same time
+// (by the same dispatch) are sorted.
+func testQueueOrder(t *testing.T, maxRuns int, maxClass map[string]int, hosts [][]string) []int {
+	queue := &runQueue{runningClass: make(map[string]int)}
+	queue.SetLimits(maxRuns, maxClass)
+
+	var (
+		order   []int
+		running []testQueueRun
+	)
+	started := make(chan testQueueRun, len(hosts))
+
+	// receives runs started by the last Acquire or release
+	collect := func(dispatched int) {
+		var batch []testQueueRun
+		for len(order)+len(batch) < dispatched {
+			select {
+			case run := <-started:
+				batch = append(batch, run)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%d run(s) started, %d expected", len(order)+len(batch), dispatched)
+			}
+		}
+		sort.Slice(batch, func(i, j int) bool { return batch[i].num < batch[j].num })
+		for _, run := range batch {
+			order = append(order, run.num)
+			running = append(running, run)
+		}
+	}
+
+	// number of runs already given their turn (running or done)
+	dispatched := func(queued int) int {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		return queued - len(queue.waiters)
+	}
+
+	for num, classes := range hosts {
+		host := &Host{Name: fmt.Sprintf("host%d", num), Classes: classes}
+		go func(num int) {
+			started <- testQueueRun{num, queue.Acquire(host)}
+		}(num)
+
+		// wait for this run to be started or queued, so the order is known
+		for {
+			queue.mutex.Lock()
+			known := queue.running + len(queue.waiters) + len(order) - len(running)
+			queue.mutex.Unlock()
+			if known == num+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		collect(dispatched(num + 1))
+	}
+
+	for len(running) > 0 {
+		run := running[0]
+		running = running[1:]
+		run.release()
+		collect(dispatched(len(hosts)))
+	}
+
+	if len(order) != len(hosts) {
+		t.Fatalf("%d run(s) started, %d expected (order: %v)", len(order), len(hosts), order)
+	}
+	return order
+}
+
+func TestRunQueueOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxRuns  int
+		maxClass map[string]int
+		hosts    [][]string
+		want     []int
+	}{
+		{"no limit", 0, nil, [][]string{{"a"}, {"b"}, {"c"}}, []int{0, 1, 2}},
+		{"global limit, first in first out", 1, nil, [][]string{{"a"}, {"b"}, {"a"}, {"c"}}, []int{0, 1, 2, 3}},
+		{"class limit", 0, map[string]int{"db": 1}, [][]string{{"db"}, {"db"}, {"web"}, {"db"}}, []int{0, 2, 1, 3}},
+		// web runs can pass the blocked db one, not the other way round
+		{"class and global limits", 2, map[string]int{"db": 1}, [][]string{{"db"}, {"db"}, {"web"}, {"web"}, {"web"}}, []int{0, 2, 1, 3, 4}},
+		// a run only blocked by the global limit can't be passed
+		{"no pass on global limit", 1, map[string]int{"db": 1}, [][]string{{"db"}, {"web"}, {"db"}, {"web"}}, []int{0, 1, 2, 3}},
+		{"several limited classes", 0, map[string]int{"db": 1, "eu": 1}, [][]string{{"db", "eu"}, {"db"}, {"eu"}, {"us"}, {"db", "us"}}, []int{0, 3, 1, 2, 4}},
+		{"unlimited class", 1, map[string]int{"db": 0}, [][]string{{"db"}, {"db"}}, []int{0, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := testQueueOrder(t, test.maxRuns, test.maxClass, test.hosts)
+			if reflect.DeepEqual(got, test.want) == false {
+				t.Errorf("start order is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunQueueSetLimits(t *testing.T) {
+	queue := &runQueue{runningClass: make(map[string]int)}
+	queue.SetLimits(1, nil)
+
+	first := queue.Acquire(&Host{Name: "a"})
+	started := make(chan func(), 2)
+	for _, name := range []string{"b", "c"} {
+		host := &Host{Name: name}
+		go func() { started <- queue.Acquire(host) }()
+	}
+
+	select {
+	case <-started:
+		t.Fatal("run started over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// waiting runs are dispatched with the new limit
+	queue.SetLimits(0, nil)
+	for i := 0; i < 2; i++ {
+		select {
+		case release := <-started:
+			release()
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiting run not started after SetLimits")
+		}
+	}
+	first()
+
+	if queue.running != 0 {
+		t.Errorf("%d run(s) still counted after their release", queue.running)
+	}
+}
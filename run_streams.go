@@ -4,15 +4,29 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// exitSuffix matches the exit status printed after a script, at the end
+// of its last output line if there's no newline
+var exitSuffix = regexp.MustCompile("__EXIT=[0-9]+$")
+
+// taskKillGrace is the delay given to the remote watchdog to kill a
+// script after its timeout, before we give up the whole run
+const taskKillGrace = 5 * time.Second
+
 func (run *Run) readStdout(std io.Reader, exitStatus chan int) {
+	defer run.streams.Done()
+	defer close(exitStatus)
 	scanner := bufio.NewScanner(std)
+	// room for the largest __STATE line
+	scanner.Buffer(make([]byte, bufio.MaxScanTokenSize), stateMaxSizeLimit+1024)
 
 	for scanner.Scan() {
 		text := scanner.Text()
@@ -20,6 +34,21 @@ func (run *Run) readStdout(std io.Reader, exitStatus chan int) {
 
 		Trace.Printf("stdout=%s (%s)\n", text, run.Host.Name)
 
+		// JSON and Nagios outputs: everything is kept until the script
+		// exit (a last line without newline is followed by __EXIT on the
+		// same line), a __STATE line can only come before the output
+		if result != nil && result.Task.Probe.Output != OutputLines {
+			if exit := exitSuffix.FindStringIndex(text); exit != nil && exit[0] > 0 {
+				result.rawOutput.WriteString(text[:exit[0]] + "\n")
+				text = text[exit[0]:]
+			}
+			state := strings.HasPrefix(text, "__STATE=") && result.rawOutput.Len() == 0
+			if exitSuffix.MatchString(text) == false && state == false {
+				result.rawOutput.WriteString(text + "\n")
+				continue
+			}
+		}
+
 		if len(text) > 2 && text[0:2] == "__" {
 			parts := strings.Split(text, "=")
 			switch parts[0] {
@@ -34,7 +63,31 @@ func (run *Run) readStdout(std io.Reader, exitStatus chan int) {
 					continue
 				}
 				Trace.Printf("EXIT detected: %s (status %d, %s)\n", text, status, run.Host.Name)
+				if result != nil {
+					switch result.Task.Probe.Output {
+					case OutputJSON:
+						result.parseJSONOutput(result.rawOutput.Bytes())
+					case OutputNagios:
+						result.parseNagiosOutput(result.rawOutput.Bytes(), status)
+					}
+				}
 				exitStatus <- status
+			case "__STATE":
+				if result == nil {
+					run.addError(fmt.Errorf("__STATE outside of a script"))
+					continue
+				}
+				state := strings.TrimPrefix(text, "__STATE=")
+				if result.stateSet == true {
+					result.addError(fmt.Errorf("__STATE defined multiple times"))
+					continue
+				}
+				if maxSize := GlobalConfigGet().StateMaxSize; len(state) > maxSize {
+					result.addError(fmt.Errorf("__STATE is too large (%d bytes, max is %d, see state_max_size)", len(state), maxSize))
+					continue
+				}
+				result.State = state
+				result.stateSet = true
 			default:
 				run.addError(fmt.Errorf("Unknown keyword: %s", text))
 			}
@@ -53,7 +106,26 @@ func (run *Run) readStdout(std io.Reader, exitStatus chan int) {
 			continue
 		}
 
-		paramName := strings.TrimSpace(text[0:sep])
+		// labelled (multi-instance) value: NAME[label]: value
+		label := ""
+		name := text[0:sep]
+		if open := strings.Index(name, "["); open != -1 {
+			end := strings.Index(text[open:], "]:")
+			if end == -1 {
+				result.addError(fmt.Errorf("invalid script output (unterminated label): '%s'", text))
+				continue
+			}
+			end += open
+			label = strings.TrimSpace(text[open+1 : end])
+			name = text[0:open]
+			sep = end + 1
+			if label == "" {
+				result.addError(fmt.Errorf("empty label: '%s'", text))
+				continue
+			}
+		}
+
+		paramName := strings.TrimSpace(name)
 		if !IsValidTokenName(paramName) {
 			result.addError(fmt.Errorf("invalid parameter name: '%s' (not a valid token name): '%s'", paramName, text))
 			continue
@@ -63,17 +135,33 @@ func (run *Run) readStdout(std io.Reader, exitStatus chan int) {
 			continue
 		}
 
-		if _, exists := result.Values[paramName]; exists == true {
-			result.addError(fmt.Errorf("parameter '%s' defined multiple times", paramName))
-			continue
-		}
-
 		value := strings.TrimSpace(text[sep+1:])
 		if len(value) == 0 {
 			result.addError(fmt.Errorf("empty value for parameter '%s'", paramName))
 			continue
 		}
 
+		if label != "" {
+			if result.Task.Probe.IsLabelled(paramName) == false {
+				result.addError(fmt.Errorf("parameter '%s' has a label, but isn't in the probe 'labelled' list", paramName))
+				continue
+			}
+			if err := result.addLabelledValue(paramName, label, value); err != nil {
+				result.addError(err)
+			}
+			continue
+		}
+
+		if result.Task.Probe.IsLabelled(paramName) {
+			result.addError(fmt.Errorf("parameter '%s' needs a label (see the probe 'labelled' list)", paramName))
+			continue
+		}
+
+		if _, exists := result.Values[paramName]; exists == true {
+			result.addError(fmt.Errorf("parameter '%s' defined multiple times", paramName))
+			continue
+		}
+
 		result.Values[paramName] = value
 	}
 
@@ -83,13 +171,19 @@ func (run *Run) readStdout(std io.Reader, exitStatus chan int) {
 }
 
 func (run *Run) readStderr(std io.Reader) {
+	defer run.streams.Done()
 	scanner := bufio.NewScanner(std)
 
 	for scanner.Scan() {
 		text := scanner.Text()
-		file := filepath.Base(run.currentTaskResult().Task.Probe.Script)
 		Trace.Printf("stderr=%s\n", text)
-		run.currentTaskResult().addError(fmt.Errorf("%s, stderr: %s", file, text))
+		result := run.currentTaskResult()
+		if result == nil {
+			run.addError(fmt.Errorf("stderr: %s", text))
+			continue
+		}
+		file := filepath.Base(result.Task.Probe.Script)
+		result.addError(fmt.Errorf("%s, stderr: %s", file, text))
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -101,12 +195,15 @@ func (run *Run) readStderr(std io.Reader) {
 // scripts -> ssh
 func (run *Run) stdinInject(out io.WriteCloser, exitStatus chan int) {
 
+	defer run.streams.Done()
 	defer out.Close()
 
-	// "pkill" dependency or Linux "ps"? (ie: not Cygwin)
-	_, err := out.Write([]byte("export __MAIN_PID=$$\nfunction __kill_subshells() { pkill -TERM -P $__MAIN_PID cat; }\nexport -f __kill_subshells\n"))
+	shell := run.Host.Shell
+	delimiter := shellScriptDelimiter()
+
+	_, err := out.Write([]byte(shellSetup(shell)))
 	if err != nil {
-		run.addError(fmt.Errorf("Error writing (setup parent bash): %s", err))
+		run.addError(fmt.Errorf("Error writing (setup parent shell): %s", err))
 		return
 	}
 
@@ -119,6 +216,8 @@ func (run *Run) stdinInject(out io.WriteCloser, exitStatus chan int) {
 		result.Host = run.Host
 		result.ExitStatus = -1
 		result.Values = make(map[string]string)
+		result.LabelledValues = make(map[string]map[string]string)
+		result.Structured = make(map[string]interface{})
 
 		var scanner *bufio.Scanner
 
@@ -142,20 +241,17 @@ func (run *Run) stdinInject(out io.WriteCloser, exitStatus chan int) {
 		}
 		args = StringExpandVariables(args, params)
 
-		// cat is needed to "focus" stdin only on the child bash
-		str := fmt.Sprintf("cat | __SCRIPT_ID=%d bash -s -- %s ; echo __EXIT=$?\n", num, args)
+		env := stateEnvName + "=" + shellQuote(ProbeStateLoad(run.Host.Name, task.Probe.Name)) + " "
+
+		// no newline after the watchdog so we dont change line numbers
+		// (its sleep uses whole seconds, never less than the timeout)
+		timeout := int(math.Ceil(task.Probe.Timeout.Seconds()))
+		str := shellTaskStart(shell, num, env, args, timeout, delimiter)
 		Trace.Printf("child(%s)=%s", run.Host.Name, str)
 
 		_, err = out.Write([]byte(str))
 		if err != nil {
-			run.addError(fmt.Errorf("Error writing (starting child bash): %s", err))
-			return
-		}
-
-		// no newline so we dont change line numbers
-		_, err = out.Write([]byte("trap __kill_subshells EXIT ; "))
-		if err != nil {
-			run.addError(fmt.Errorf("Error writing (init child bash): %s", err))
+			run.addError(fmt.Errorf("Error writing (starting child shell): %s", err))
 			return
 		}
 
@@ -169,8 +265,8 @@ func (run *Run) stdinInject(out io.WriteCloser, exitStatus chan int) {
 			}
 		}
 
-		Trace.Printf("killing subshell (%s)\n", run.Host.Name)
-		_, err = out.Write([]byte("__kill_subshells\n"))
+		Trace.Printf("ending subshell (%s)\n", run.Host.Name)
+		_, err = out.Write([]byte(shellTaskEnd(shell, delimiter)))
 		if err != nil {
 			run.addError(fmt.Errorf("Error writing (while killing subshell): %s", err))
 			return
@@ -181,39 +277,62 @@ func (run *Run) stdinInject(out io.WriteCloser, exitStatus chan int) {
 			return
 		}
 
-		status := <-exitStatus
-		result.ExitStatus = status
-		if status != 0 {
-			result.addError(fmt.Errorf("detected non-zero exit status: %d", status))
+		var status int
+		deadline := result.StartTime.Add(task.Probe.Timeout + taskKillGrace)
+		select {
+		case st, ok := <-exitStatus:
+			if ok == false {
+				return // stdout is closed, run is over
+			}
+			status = st
+		case <-time.After(time.Until(deadline)):
+			result.addError(fmt.Errorf("timeout: script was not killed after %s, aborting run", task.Probe.Timeout))
+			run.addError(fmt.Errorf("unable to kill '%s' script after its timeout", task.Probe.Name))
+			close(run.abort)
+			return
 		}
 
+		result.ExitStatus = status
 		result.Duration = time.Now().Sub(result.StartTime)
-		if result.Duration > result.Task.Probe.Timeout {
-			result.addError(fmt.Errorf("task duration was too long (timeout is %s)", result.Task.Probe.Timeout))
+
+		if result.Duration > task.Probe.Timeout {
+			if status == 128+9 {
+				result.addError(fmt.Errorf("timeout: script killed after %s", task.Probe.Timeout))
+				continue
+			}
+			result.addError(fmt.Errorf("task duration was too long (timeout is %s)", task.Probe.Timeout))
+		}
+
+		// Nagios plugins statuses are checked by parseNagiosOutput
+		if status != 0 && task.Probe.Output != OutputNagios {
+			result.addError(fmt.Errorf("detected non-zero exit status: %d", status))
 		}
 	}
 }
 
 func (run *Run) preparePipes() error {
-	exitStatus := make(chan int)
-	session := run.Host.Connection.Session
+	// buffered, so readStdout never blocks if stdinInject gave up
+	exitStatus := make(chan int, len(run.Tasks))
+	transport := run.Host.Transport
 
-	stdin, err := session.StdinPipe()
+	stdin, err := transport.StdinPipe()
 	if err != nil {
 		return fmt.Errorf("Unable to setup stdin for session: %v", err)
 	}
-	go run.stdinInject(stdin, exitStatus)
 
-	stdout, err := session.StdoutPipe()
+	stdout, err := transport.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("Unable to setup stdout for session: %v", err)
 	}
-	go run.readStdout(stdout, exitStatus)
 
-	stderr, err := session.StderrPipe()
+	stderr, err := transport.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("Unable to setup stderr for session: %v", err)
 	}
+
+	run.streams.Add(3)
+	go run.stdinInject(stdin, exitStatus)
+	go run.readStdout(stdout, exitStatus)
 	go run.readStderr(stderr)
 
 	return nil
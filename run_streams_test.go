@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testReadStdout reads the output of a single script of the probe,
+// returning its result and exit status
+func testReadStdout(t *testing.T, probe *Probe, stdout string) (*Run, *TaskResult, int) {
+	globalsSet(&Config{StateMaxSize: 100}, nil, nil)
+
+	host := &Host{Name: "h"}
+	result := &TaskResult{
+		Task:           &Task{Probe: probe},
+		Host:           host,
+		Values:         make(map[string]string),
+		LabelledValues: make(map[string]map[string]string),
+		Structured:     make(map[string]interface{}),
+	}
+	run := &Run{Host: host, TaskResults: []*TaskResult{result}}
+
+	exitStatus := make(chan int, 1)
+	run.streams.Add(1)
+	run.readStdout(strings.NewReader(stdout), exitStatus)
+
+	status, ok := <-exitStatus
+	if ok == false {
+		t.Fatalf("no exit status for: %q", stdout)
+	}
+	return run, result, status
+}
+
+func TestReadStdoutJSON(t *testing.T) {
+	tests := []struct {
+		stdout string
+		values map[string]string
+		state  string
+		status int
+	}{
+		{"{\"A\": 1}\n__EXIT=0\n", map[string]string{"A": "1"}, "", 0},
+		// no newline after the document
+		{"{\"A\": 1}__EXIT=2\n", map[string]string{"A": "1"}, "", 2},
+		// __EXIT= and __STATE= in the document
+		{"{\"A\": \"__EXIT=x\", \"B\": \"y __EXIT=3\"}\n__EXIT=0\n", map[string]string{"A": "__EXIT=x", "B": "y __EXIT=3"}, "", 0},
+		{"{\"A\": \"x\"__EXIT=1\n", nil, "", 1},
+		{"{\n\"A\": 1\n}\n__STATE=s\n__EXIT=0\n", nil, "", 0},
+		// a state before the document
+		{"__STATE=s\n{\"A\": 1}\n__EXIT=0\n", map[string]string{"A": "1"}, "s", 0},
+	}
+
+	for _, test := range tests {
+		run, result, status := testReadStdout(t, &Probe{Name: "p", Output: OutputJSON}, test.stdout)
+		if len(run.Errors) > 0 {
+			t.Errorf("%q: run errors: %q", test.stdout, run.Errors)
+		}
+		if status != test.status {
+			t.Errorf("%q: status = %d, want %d", test.stdout, status, test.status)
+		}
+		if result.State != test.state {
+			t.Errorf("%q: state = %q, want %q", test.stdout, result.State, test.state)
+		}
+		if test.values == nil {
+			if len(result.Errors) == 0 {
+				t.Errorf("%q: invalid JSON error expected", test.stdout)
+			}
+			continue
+		}
+		if len(result.Errors) > 0 {
+			t.Errorf("%q: errors: %q", test.stdout, result.Errors)
+		}
+		if reflect.DeepEqual(result.Values, test.values) == false {
+			t.Errorf("%q: values = %q, want %q", test.stdout, result.Values, test.values)
+		}
+	}
+}
+
+func TestReadStdoutLabels(t *testing.T) {
+	tests := []struct {
+		stdout   string
+		values   map[string]string
+		labelled map[string]map[string]string
+		errors   int
+	}{
+		{"A[x]: 1\nA[y]: 2\nB: 3\n", map[string]string{"B": "3"}, map[string]map[string]string{"x": {"A": "1"}, "y": {"A": "2"}}, 0},
+		{"A[C:]: 5\n", nil, map[string]map[string]string{"C:": {"A": "5"}}, 0},
+		{"A[a]b]: 2\n", nil, map[string]map[string]string{"a]b": {"A": "2"}}, 0},
+		{"A[ /var ]: 3\nA[x y]: 4\n", nil, map[string]map[string]string{"/var": {"A": "3"}, "x y": {"A": "4"}}, 0},
+		{"A[x]: 1\nC[x]: 2\n", nil, map[string]map[string]string{"x": {"A": "1", "C": "2"}}, 0},
+
+		{"A[]: 1\n", nil, nil, 1},
+		{"A[x: 1\n", nil, nil, 1},
+		{"A[x]: \n", nil, nil, 1},
+		{"A[x]: 1\nA[x]: 2\n", nil, map[string]map[string]string{"x": {"A": "1"}}, 1},
+		{"a[x]: 1\n", nil, nil, 1},
+		// A is labelled, B is not
+		{"A: 1\n", nil, nil, 1},
+		{"B[x]: 1\n", nil, nil, 1},
+	}
+
+	probe := &Probe{Name: "p", Output: OutputLines, Labelled: []string{"A", "C"}}
+	for _, test := range tests {
+		_, result, _ := testReadStdout(t, probe, test.stdout+"__EXIT=0\n")
+		if len(result.Errors) != test.errors {
+			t.Errorf("%q: errors = %q, want %d", test.stdout, result.Errors, test.errors)
+		}
+		if test.values == nil {
+			test.values = map[string]string{}
+		}
+		if test.labelled == nil {
+			test.labelled = map[string]map[string]string{}
+		}
+		if reflect.DeepEqual(result.Values, test.values) == false {
+			t.Errorf("%q: values = %q, want %q", test.stdout, result.Values, test.values)
+		}
+		if reflect.DeepEqual(result.LabelledValues, test.labelled) == false {
+			t.Errorf("%q: labelled values = %q, want %q", test.stdout, result.LabelledValues, test.labelled)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduledHost holds a Host and the channels of its Schedule goroutine
+type scheduledHost struct {
+	host *Host
+	stop chan struct{}
+	done chan struct{}
+	wake chan struct{}
+}
+
+var (
+	scheduledHosts      = make(map[string]*scheduledHost)
+	scheduledHostsMutex sync.Mutex
+)
+
+// scheduleHost starts the Schedule goroutine of the host, after the
+// given wait duration
+func scheduleHost(host *Host, wait time.Duration) {
+	sh := &scheduledHost{
+		host: host,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+
+	scheduledHostsMutex.Lock()
+	scheduledHosts[host.Name] = sh
+	scheduledHostsMutex.Unlock()
+
+	go func() {
+		defer close(sh.done)
+		if wait > 0 {
+			select {
+			case <-sh.stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+		host.Schedule(sh.stop, sh.wake)
+	}()
+}
+
+// unscheduleHost stops the Schedule goroutine of the named host and
+// waits for its current run (if any) to end
+func unscheduleHost(name string) {
+	scheduledHostsMutex.Lock()
+	sh, exists := scheduledHosts[name]
+	delete(scheduledHosts, name)
+	scheduledHostsMutex.Unlock()
+
+	if exists == false {
+		return
+	}
+	close(sh.stop)
+	<-sh.done
+}
+
+// wakeChildHosts forces an immediate run of every scheduled host with
+// the named parent
+func wakeChildHosts(parent string) {
+	scheduledHostsMutex.Lock()
+	defer scheduledHostsMutex.Unlock()
+
+	for _, sh := range scheduledHosts {
+		for _, hostParent := range sh.host.Parents {
+			if hostParent == parent {
+				select {
+				case sh.wake <- struct{}{}:
+				default: // already woken up
+				}
+			}
+		}
+	}
+}
+
+// scheduledHostsList returns currently scheduled hosts, by name
+func scheduledHostsList() map[string]*Host {
+	scheduledHostsMutex.Lock()
+	defer scheduledHostsMutex.Unlock()
+
+	hosts := make(map[string]*Host)
+	for name, sh := range scheduledHosts {
+		hosts[name] = sh.host
+	}
+	return hosts
+}
+
+func scheduleHosts(hosts []*Host, config *Config) {
+	for i, host := range hosts {
+		var wait time.Duration
+		if config.StartTimeSpreadSeconds > 0 {
+			// wait, to ease global load
+			fact := float32(i) / float32(len(hosts)) * 1000 * float32(config.StartTimeSpreadSeconds)
+			wait = time.Duration(fact) * time.Millisecond
+		}
+		scheduleHost(host, wait)
+	}
+}
+
+// unscheduleAllHosts stops every Schedule goroutine and waits for
+// current runs to end
+func unscheduleAllHosts() {
+	scheduledHostsMutex.Lock()
+	list := scheduledHosts
+	scheduledHosts = make(map[string]*scheduledHost)
+	scheduledHostsMutex.Unlock()
+
+	for _, sh := range list {
+		close(sh.stop)
+	}
+	for _, sh := range list {
+		<-sh.done
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Remote shells, used to run probe scripts on hosts
+const (
+	ShellBash = "bash"
+	ShellSh   = "sh" // POSIX sh only (BusyBox, dash, …), see shellKillTree
+)
+
+// shellKillTree is a POSIX sh script killing a process (given as $1) and
+// all its descendants, except the calling shell and its own children:
+// without a terminal, dash or BusyBox ash can't use job control, so the
+// child shell can't have its own process group. Descendants are found
+// with ps and awk, or by reading /proc (Linux) if one of them is missing,
+// so minimal images still work. Without both, only the child shell is
+// killed.
+const shellKillTree = `if command -v ps >/dev/null && command -v awk >/dev/null ; then ` +
+	`kill -KILL $1 $(ps -A -o pid= -o ppid= | awk -v r=$1 -v s=$$ "{ p[\$1] = \$2 } END { for (i in p) { j = i; while ((j in p) && j != r && j != s) j = p[j]; if (j == r) print i } }") ; ` +
+	`else t=" $1 " ; c=1 ; while [ $c = 1 ] ; do c=0 ; for f in /proc/[0-9]*/status ; do ` +
+	`p=${f#/proc/} ; p=${p%/status} ; case "$t" in *" $p "*) continue ;; esac ; [ "$p" = $$ ] && continue ; ` +
+	`q= ; while read -r k v ; do if [ "$k" = PPid: ] ; then q=$v ; break ; fi ; done < $f ; ` +
+	`case "$t" in *" $q "*) t="$t$p " ; c=1 ;; esac ; done ; done ; kill -KILL $t ; fi`
+
+// shellBootstrap returns the command starting the main remote shell
+func shellBootstrap(shell string) string {
+	return shell + " -s --"
+}
+
+// shellSetup returns commands preparing the main remote shell
+func shellSetup(shell string) string {
+	if shell == ShellSh {
+		// fd 3 keeps stderr for children
+		return "exec 3>&2 2>/dev/null\n"
+	}
+
+	// "pkill" dependency or Linux "ps"? (ie: not Cygwin)
+	// "set -m" gives each child pipeline its own process group, so the
+	// watchdog can kill the whole child (and only it) with "kill 0", and
+	// fd 3 keeps stderr for children while parent's job notifications
+	// ("Killed", etc) are discarded
+	return "export __MAIN_PID=$$\nset -m\nexec 3>&2 2>/dev/null\nfunction __kill_subshells() { kill -TERM $__WATCHDOG 2>/dev/null; pkill -TERM -P $__MAIN_PID cat; }\nexport -f __kill_subshells\n"
+}
+
+// shellScriptDelimiter returns a unique here-document delimiter for
+// scripts of a run (sh only)
+func shellScriptDelimiter() string {
+	return "__NOSEE_EOF_" + strings.Replace(uuid.NewV4().String(), "-", "", -1)
+}
+
+// shellTaskStart returns commands starting a child shell for a script
+// (with env, "VAR='value' " assignments, in its environment), then its
+// watchdog (with no newline, so the script line numbers are not
+// changed). Its exit status is printed with __EXIT.
+func shellTaskStart(shell string, num int, env string, args string, timeout int, delimiter string) string {
+	if shell == ShellSh {
+		// the script is given as a here-document, read by the main shell
+		// before the child is started, so there's nothing to kill at the
+		// end of the script (only the watchdog, and the child itself, with
+		// everything it started, on timeout: the watchdog is replaced by
+		// shellKillTree, so it knows its own PID)
+		str := fmt.Sprintf("%s__SCRIPT_ID=%d sh -s -- %s <<'%s' 2>&3 ; echo __EXIT=$?\n", env, num, args, delimiter)
+		watchdog := fmt.Sprintf("( trap 'kill $! ; exit' TERM ; sleep %d & wait ; exec sh -c '%s' sh $$ ) >/dev/null 2>&1 </dev/null & __WATCHDOG=$! ; ", timeout, shellKillTree)
+		return str + "trap 'kill -TERM $__WATCHDOG 2>/dev/null' EXIT ; " + watchdog
+	}
+
+	// cat is needed to "focus" stdin only on the child bash
+	str := fmt.Sprintf("cat | %s__SCRIPT_ID=%d bash -s -- %s 2>&3 ; echo __EXIT=$?\n", env, num, args)
+	watchdog := fmt.Sprintf("( trap 'kill $! ; exit' TERM ; sleep %d & wait ; kill -KILL 0 ) >/dev/null 2>&1 </dev/null & __WATCHDOG=$! ; ", timeout)
+	return str + "trap __kill_subshells EXIT ; " + watchdog
+}
+
+// shellTaskEnd returns the line ending the script of a child shell
+func shellTaskEnd(shell string, delimiter string) string {
+	if shell == ShellSh {
+		return delimiter + "\n"
+	}
+	return "__kill_subshells\n"
+}
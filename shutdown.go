@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// backgroundJobs tracks goroutines (alert commands, loggers, saves…)
+// that must be waited for before exiting
+var backgroundJobs sync.WaitGroup
+
+// shutdown stops heartbeats and scheduling of new runs, waits for current
+// runs and background jobs (no longer than timeout) and then saves current
+// fails and task schedules. Keepalives of persistent connections are
+// stopped first, and each connection is closed once its host is
+// unscheduled (after its current run, if any), so nothing is left
+// running behind our back during the final saves.
+func shutdown(timeout time.Duration) {
+	Info.Printf("shutting down, waiting for current runs (max %s)…", timeout)
+
+	for _, host := range scheduledHostsList() {
+		if host.Connection != nil {
+			host.Connection.stopKeepalive()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		heartbeatsUnschedule()
+		unscheduleAllHosts()
+		backgroundJobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		Info.Print("all runs and jobs ended")
+	case <-time.After(timeout):
+		Warning.Printf("shutdown timeout (%s), some runs or jobs were interrupted", timeout)
+	}
+
+	CurrentFailsFlush()
+	TaskSchedulesFlush()
+}
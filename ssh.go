@@ -5,9 +5,8 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -26,29 +26,70 @@ import (
 type Connection struct {
 	User            string
 	Auths           []ssh.AuthMethod
-	Host            string
+	Host            string // primary address (first of Hosts)
+	Hosts           []string
+	HostsMode       string
 	Port            int
-	Ciphers         []string
+	Algorithms      SSHAlgorithms
+	Negotiated      *SSHNegotiated
+	Jumps           []*JumpHop
+	KnownHosts      string
 	SSHConnTimeWarn time.Duration
-	Session         *ssh.Session
-	Client          *ssh.Client
+	ConnectTimeout  time.Duration
+
+	SSHConnTimeNeededFailures int
+	Persistent                bool
+	Keepalive                 time.Duration
+	Session                   *ssh.Session
+	Client                    *ssh.Client
+
+	mutex         sync.Mutex
+	keepaliveStop chan struct{}
+	jumpsRelease  func()
+	answered      string
+	timings       SSHDialTimings
+	hostName      string
 }
 
-// Close will clone the connection and the session
+// Close will close the session, and the connection too if it's not
+// a persistent one
 func (connection *Connection) Close() error {
-	var (
-		sessionError error
-		clientError  error
-	)
-
-	Trace.Printf("SSH closing connection (%s)\n", connection.Host)
+	if connection.Persistent == true {
+		return connection.closeSession()
+	}
+	return connection.Disconnect()
+}
 
+func (connection *Connection) closeSession() error {
+	var sessionError error
 	if connection.Session != nil {
 		sessionError = connection.Session.Close()
+		connection.Session = nil
 	}
+	return sessionError
+}
+
+// Disconnect will close the session and the connection (even
+// a persistent one)
+func (connection *Connection) Disconnect() error {
+	var clientError error
+
+	Trace.Printf("SSH closing connection (%s)\n", connection.Host)
+
+	sessionError := connection.closeSession()
+
+	connection.stopKeepalive()
+
+	connection.mutex.Lock()
 	if connection.Client != nil {
 		clientError = connection.Client.Close()
+		connection.Client = nil
 	}
+	if connection.jumpsRelease != nil {
+		connection.jumpsRelease()
+		connection.jumpsRelease = nil
+	}
+	connection.mutex.Unlock()
 
 	if clientError != nil {
 		return clientError
@@ -57,6 +98,54 @@ func (connection *Connection) Close() error {
 	return sessionError
 }
 
+// stopKeepalive stops the keepalive of a persistent connection, if any,
+// leaving the connection itself open
+func (connection *Connection) stopKeepalive() {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	if connection.keepaliveStop != nil {
+		close(connection.keepaliveStop)
+		connection.keepaliveStop = nil
+	}
+}
+
+// keepalive regularly checks a persistent connection, closing it if
+// the server does not answer (Connect will then dial again)
+func (connection *Connection) keepalive(client *ssh.Client, stop chan struct{}) {
+	ticker := time.NewTicker(connection.Keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-stop:
+			return
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			Info.Printf("SSH keepalive failed for %s: %s", connection.Host, err)
+		case <-time.After(connection.Keepalive):
+			Info.Printf("SSH keepalive: no answer from %s after %s", connection.Host, connection.Keepalive)
+		}
+
+		client.Close()
+		return
+	}
+}
+
 // knownHostHash hash hostname using salt64 like ssh is
 // doing for "hashed" .ssh/known_hosts files
 func knownHostHash(hostname string, salt64 string) string {
@@ -72,21 +161,62 @@ func knownHostHash(hostname string, salt64 string) string {
 	return hash
 }
 
-// Implements ssh.HostKeyCallback which is now required due to CVE-2017-3204
+// hostKeyChecker returns an ssh.HostKeyCallback (now required due to
+// CVE-2017-3204) using the given known_hosts file and the Nosee host key
+// store (see host_keys.go). Unknown host keys are added to the store when
+// ssh_trust_on_first_use is enabled.
 // see https://github.com/golang/go/issues/29286 for the ecdsa-sha2-nistp256 part
 // ("If ClientConfig.HostKeyAlgorithms is not set, a reasonable default is set for acceptable host key type")
-func hostKeyChecker(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	path := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
-	hostKeyCallback, err := knownhosts.New(path)
-	if err != nil {
-		return err
+func hostKeyChecker(knownHosts string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// host certificate signed by a CA of ssh_host_ca_file? (CAs of
+		// known_hosts, with @cert-authority marker, are checked by knownhosts)
+		if cert, ok := key.(*ssh.Certificate); ok == true && isHostCA(cert.SignatureKey) {
+			checker := ssh.CertChecker{
+				IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+					return true
+				},
+			}
+			if err := checker.CheckHostKey(hostname, remote, key); err != nil {
+				return fmt.Errorf("host certificate of %s: %s", hostname, err)
+			}
+			return nil
+		}
+
+		hostKeyCallback, err := hostKeyKnownHosts(knownHosts)
+		if err != nil {
+			return err
+		}
+
+		err = hostKeyCallback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) == true {
+			if len(keyErr.Want) > 0 {
+				hostKeyChanged(hostname, keyErr.Want, key)
+				return fmt.Errorf("host key of %s has changed (%s %s), see 'trust' command if it's expected", hostname, key.Type(), ssh.FingerprintSHA256(key))
+			}
+			if GlobalConfigGet().SSHTrustOnFirstUse == true {
+				Info.Printf("trusting %s host key on first use (%s %s)", hostname, key.Type(), ssh.FingerprintSHA256(key))
+				return HostKeyStorePin(hostname, key)
+			}
+			return fmt.Errorf("unknown host key for %s (%s %s), see 'trust' command or use ssh client to manually connect to %s (you may have to set host_key_algorithms, ex: ecdsa-sha2-nistp256)", hostname, key.Type(), ssh.FingerprintSHA256(key), hostname)
+		}
+		return fmt.Errorf("%s, use ssh client to manually connect to %s (you may have to set host_key_algorithms, ex: ecdsa-sha2-nistp256)", err, hostname)
 	}
+}
 
-	err = hostKeyCallback(hostname, remote, key)
-	if err != nil {
-		return fmt.Errorf("%s, use ssh client to manually connect to %s (you may have to specify algo: ssh -o HostKeyAlgorithms=ecdsa-sha2-nistp256 …)", err, hostname)
+// isHostCA returns true if the key is one of ssh_host_ca_file CAs
+func isHostCA(key ssh.PublicKey) bool {
+	for _, ca := range GlobalConfigGet().SSHHostCAs {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
 // Old ssh.HostKeyCallback implementation
@@ -155,75 +285,324 @@ func hostKeyBilndTrustChecker(hostname string, remote net.Addr, key ssh.PublicKe
 	return nil
 }
 
-// Connect will dial SSH server and open a session
-func (connection *Connection) Connect() error {
+// sshClientConfig returns the SSH client configuration for the given
+// user, auth methods and algorithms, with the configured host key checking
+// (see hostKeyChecker)
+func sshClientConfig(user string, auths []ssh.AuthMethod, algos *SSHAlgorithms, knownHosts string) *ssh.ClientConfig {
 	sshConfig := &ssh.ClientConfig{
-		User: connection.User,
-		Auth: connection.Auths,
+		User:              user,
+		Auth:              auths,
+		HostKeyAlgorithms: algos.HostKeyAlgorithms,
+		Config: ssh.Config{
+			Ciphers:      algos.Ciphers,
+			KeyExchanges: algos.KeyExchanges,
+			MACs:         algos.MACs,
+		},
 	}
 
-	if GlobalConfig.SSHBlindTrust == true {
+	if GlobalConfigGet().SSHBlindTrust == true {
 		sshConfig.HostKeyCallback = hostKeyBilndTrustChecker
 	} else {
-		sshConfig.HostKeyCallback = hostKeyChecker
+		sshConfig.HostKeyCallback = hostKeyChecker(knownHosts)
 	}
+	return sshConfig
+}
 
-	if len(connection.Ciphers) > 0 {
-		sshConfig.Config = ssh.Config{
-			Ciphers: connection.Ciphers,
+// Connect will dial SSH server and open a session. A persistent
+// connection is re-used if it's still alive.
+func (connection *Connection) Connect() error {
+	if connection.Persistent == true {
+		connection.mutex.Lock()
+		client := connection.Client
+		connection.mutex.Unlock()
+
+		if client != nil {
+			session, err := client.NewSession()
+			if err == nil {
+				connection.Session = session
+				connection.mutex.Lock()
+				connection.timings = SSHDialTimings{}
+				connection.mutex.Unlock()
+				return nil
+			}
+			Info.Printf("SSH persistent connection to %s is dead (%s), reconnecting", connection.Host, err)
+			connection.Disconnect()
 		}
 	}
 
-	dial, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", connection.Host, connection.Port), sshConfig)
-	Trace.Printf("SSH connection to %s@%s:%d\n", connection.User, connection.Host, connection.Port)
+	sshConfig := sshClientConfig(connection.User, connection.Auths, &connection.Algorithms, connection.KnownHosts)
+
+	var (
+		via          *ssh.Client
+		jumpsRelease func()
+	)
+	if len(connection.Jumps) > 0 {
+		var err error
+		via, jumpsRelease, err = dialJumps(connection.Jumps, connection.KnownHosts, connection.ConnectTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	dial, negotiated, addr, timings, err := connection.dialAddresses(via, sshConfig)
+	connection.mutex.Lock()
+	connection.timings = *timings
+	connection.mutex.Unlock()
 	if err != nil {
-		return fmt.Errorf("Failed to dial: %s", err)
+		if jumpsRelease != nil {
+			jumpsRelease()
+			last := connection.Jumps[len(connection.Jumps)-1]
+			return fmt.Errorf("%s (through jump host '%s')", err, last.Name)
+		}
+		return err
 	}
-	connection.Client = dial
+	Trace.Printf("SSH connection to %s@%s\n", connection.User, addr)
 
 	session, err := dial.NewSession()
 	if err != nil {
+		dial.Close()
+		if jumpsRelease != nil {
+			jumpsRelease()
+		}
 		return fmt.Errorf("Failed to create session: %s", err)
 	}
+
+	connection.mutex.Lock()
+	connection.Client = dial
+	connection.Negotiated = negotiated
+	connection.answered = addr
+	connection.jumpsRelease = jumpsRelease
+	if connection.Persistent == true {
+		connection.keepaliveStop = make(chan struct{})
+		go connection.keepalive(dial, connection.keepaliveStop)
+	}
+	connection.mutex.Unlock()
 	connection.Session = session
 
 	return nil
 }
 
-// PublicKeyFile returns an AuthMethod using a private key file
-func PublicKeyFile(file string) ssh.AuthMethod {
+// Timings returns the duration of each phase of the last connection
+// (all zero if a persistent connection was re-used)
+func (connection *Connection) Timings() SSHDialTimings {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.timings
+}
+
+// StdinPipe returns a pipe connected to the session standard input
+func (connection *Connection) StdinPipe() (io.WriteCloser, error) {
+	if connection.Session == nil {
+		return nil, errors.New("no SSH session")
+	}
+	return connection.Session.StdinPipe()
+}
+
+// StdoutPipe returns a pipe connected to the session standard output
+func (connection *Connection) StdoutPipe() (io.Reader, error) {
+	if connection.Session == nil {
+		return nil, errors.New("no SSH session")
+	}
+	return connection.Session.StdoutPipe()
+}
+
+// StderrPipe returns a pipe connected to the session standard error
+func (connection *Connection) StderrPipe() (io.Reader, error) {
+	if connection.Session == nil {
+		return nil, errors.New("no SSH session")
+	}
+	return connection.Session.StderrPipe()
+}
+
+// Run runs cmd on the remote host (see ssh.Session.Run)
+func (connection *Connection) Run(cmd string) error {
+	if connection.Session == nil {
+		return errors.New("no SSH session")
+	}
+	return connection.Session.Run(cmd)
+}
+
+// errHostKeyFetched stops the SSH handshake once the host key is known
+var errHostKeyFetched = errors.New("host key fetched")
+
+// FetchHostKey connects to the SSH server at the given address (thru
+// jump hosts, if any) and returns its host key, without any check or
+// authentication
+func (connection *Connection) FetchHostKey(addr string) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+
+	sshConfig := sshClientConfig(connection.User, nil, &connection.Algorithms, connection.KnownHosts)
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKey = key
+		return errHostKeyFetched
+	}
+
+	var via *ssh.Client
+	if len(connection.Jumps) > 0 {
+		client, release, err := dialJumps(connection.Jumps, connection.KnownHosts, connection.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		via = client
+	}
+
+	client, _, _, err := sshDialVia(via, addr, sshConfig, connection.ConnectTimeout)
+	if err == nil {
+		client.Close()
+		return nil, errors.New("no host key received")
+	}
+	if hostKey == nil {
+		return nil, err
+	}
+	return hostKey, nil
+}
+
+// Address returns the "host:port" primary address of the SSH server
+func (connection *Connection) Address() string {
+	return hostPortAddress(connection.Host, connection.Port)
+}
+
+// privateKeySigner returns a Signer using a private key file and an
+// optional passphrase. Every key type and format supported by x/crypto/ssh
+// can be used (PEM, PKCS#8, OpenSSH, encrypted or not).
+func privateKeySigner(file, passphrase string) (ssh.Signer, error) {
 	buffer, err := ioutil.ReadFile(file)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	key, err := ssh.ParsePrivateKey(buffer)
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(buffer, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("parsing key '%s': %s", file, err)
+		}
+		return signer, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(buffer)
 	if err != nil {
-		return nil
+		if _, ok := err.(*ssh.PassphraseMissingError); ok == true {
+			return nil, fmt.Errorf("key '%s' is encrypted, a passphrase is needed (see key_passphrase parameter)", file)
+		}
+		return nil, fmt.Errorf("parsing key '%s': %s", file, err)
 	}
-	return ssh.PublicKeys(key)
+	return signer, nil
+}
+
+// PublicKeyFile returns an AuthMethod using a private key file
+func PublicKeyFile(file string) (ssh.AuthMethod, error) {
+	key, err := privateKeySigner(file, "")
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(key), nil
 }
 
 // PublicKeyFilePassPhrase returns an AuthMethod using a private key file
 // and a passphrase
-func PublicKeyFilePassPhrase(file, passphrase string) ssh.AuthMethod {
-	buffer, err := ioutil.ReadFile(file)
+func PublicKeyFilePassPhrase(file, passphrase string) (ssh.AuthMethod, error) {
+	key, err := privateKeySigner(file, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(key), nil
+}
+
+// certSigner returns a Signer using the OpenSSH user certificate
+// file of the given key
+func certSigner(key ssh.Signer, certFile string) (ssh.Signer, error) {
+	buffer, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate: %s", err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate '%s': %s", certFile, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if ok == false {
+		return nil, fmt.Errorf("'%s' is not a certificate", certFile)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("'%s' is not a user certificate", certFile)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("certificate '%s': %s", certFile, err)
 	}
+	return signer, nil
+}
 
-	block, _ := pem.Decode(buffer)
-	private, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+// certExpired returns an error if the certificate is not valid
+// (yet or anymore) at the given time
+func certExpired(cert *ssh.Certificate, certFile string, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("certificate '%s' is not valid yet (valid after %s)", certFile, time.Unix(int64(cert.ValidAfter), 0))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate '%s' has expired (valid before %s)", certFile, time.Unix(int64(cert.ValidBefore), 0))
+	}
+	return nil
+}
+
+// CertificateFile returns an AuthMethod using a private key file (with
+// an optional passphrase) and its OpenSSH certificate. The certificate is
+// read again for each connection, so short-lived certificates can be
+// renewed on disk without reloading Nosee.
+func CertificateFile(keyFile, passphrase, certFile string) (ssh.AuthMethod, error) {
+	key, err := privateKeySigner(keyFile, passphrase)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	block.Headers = nil
-	block.Bytes = private
-	key, err := ssh.ParsePrivateKey(pem.EncodeToMemory(block))
+
+	signer, err := certSigner(key, certFile)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	if err := certExpired(signer.PublicKey().(*ssh.Certificate), certFile, time.Now()); err != nil {
+		Warning.Printf("%s", err)
+	}
+
+	cb := func() ([]ssh.Signer, error) {
+		signer, err := certSigner(key, certFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := certExpired(signer.PublicKey().(*ssh.Certificate), certFile, time.Now()); err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{signer}, nil
+	}
+	return ssh.PublicKeysCallback(cb), nil
+}
+
+// ReadHostCAFile returns host certificate authorities (public keys, one
+// per line, authorized_keys format) of the given file
+func ReadHostCAFile(file string) ([]ssh.PublicKey, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(buffer)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("parsing '%s': %s", file, err)
+		}
+		keys = append(keys, key)
+		buffer = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key found in '%s'", file)
 	}
-	return ssh.PublicKeys(key)
+	return keys, nil
 }
 
 // SSHAgent returns an AuthMethod using SSH agent connection. The pubkeyFile
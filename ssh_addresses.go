@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How multiple addresses of a host are dialed
+const (
+	HostsFailover = "failover" // in order, the first answering one is used
+	HostsRace     = "race"     // all at once, the fastest one is used
+)
+
+// hostPortAddress returns the "host:port" address, with brackets for
+// IPv6 literals ("[::1]:22")
+func hostPortAddress(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Addresses returns every address of the host, primary one first
+func (connection *Connection) Addresses() []string {
+	var addresses []string
+	for _, host := range connection.Hosts {
+		addresses = append(addresses, hostPortAddress(host, connection.Port))
+	}
+	return addresses
+}
+
+// AnsweredAddress returns the address used by the current (or last)
+// connection
+func (connection *Connection) AnsweredAddress() string {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.answered
+}
+
+// addressResult is the outcome of the dial of one address
+type addressResult struct {
+	num        int
+	client     *ssh.Client
+	negotiated *SSHNegotiated
+	timings    *SSHDialTimings
+	err        error
+}
+
+// addressesError returns an error listing every failed address (the
+// original error is returned as-is if the host has only one address)
+func addressesError(addresses []string, errs []error) error {
+	if len(addresses) == 1 {
+		return errs[0]
+	}
+	var list []string
+	for num, addr := range addresses {
+		if errs[num] != nil {
+			list = append(list, fmt.Sprintf("%s: %s", addr, errs[num]))
+		}
+	}
+	return fmt.Errorf("no address answered (%s)", strings.Join(list, "; "))
+}
+
+// dialAddresses dials addresses of the host (thru the via client, if not
+// nil), in order or raced (see HostsMode), and returns the client of the
+// answering address (and its connection timings, or the ones of the
+// last failed address)
+func (connection *Connection) dialAddresses(via *ssh.Client, sshConfig *ssh.ClientConfig) (*ssh.Client, *SSHNegotiated, string, *SSHDialTimings, error) {
+	addresses := connection.Addresses()
+	errs := make([]error, len(addresses))
+	var timings *SSHDialTimings
+
+	if connection.HostsMode != HostsRace || len(addresses) == 1 {
+		for num, addr := range addresses {
+			client, negotiated, dialTimings, err := sshDialVia(via, addr, sshConfig, connection.ConnectTimeout)
+			timings = dialTimings
+			if err != nil {
+				Trace.Printf("SSH dial of %s failed: %s", addr, err)
+				errs[num] = err
+				continue
+			}
+			if num > 0 {
+				connection.fallbackUsed(addr, errs[0])
+			} else {
+				connection.primaryUsed()
+			}
+			return client, negotiated, addr, timings, nil
+		}
+		return nil, nil, "", timings, addressesError(addresses, errs)
+	}
+
+	results := make(chan addressResult, len(addresses))
+	for num, addr := range addresses {
+		go func(num int, addr string) {
+			client, negotiated, timings, err := sshDialVia(via, addr, sshConfig, connection.ConnectTimeout)
+			results <- addressResult{num, client, negotiated, timings, err}
+		}(num, addr)
+	}
+
+	for pending := len(addresses); pending > 0; pending-- {
+		res := <-results
+		if res.err != nil {
+			Trace.Printf("SSH dial of %s failed: %s", addresses[res.num], res.err)
+			errs[res.num] = res.err
+			timings = res.timings
+			continue
+		}
+
+		// the winner: close other clients, and find (once known) if the
+		// primary address is down
+		go func(pending int, winner int) {
+			primaryErr := errs[0]
+			for ; pending > 0; pending-- {
+				other := <-results
+				if other.client != nil {
+					other.client.Close()
+				}
+				if other.num == 0 {
+					primaryErr = other.err
+				}
+			}
+			if winner == 0 || primaryErr == nil {
+				connection.primaryUsed()
+				return
+			}
+			connection.fallbackUsed(addresses[winner], primaryErr)
+		}(pending-1, res.num)
+
+		return res.client, res.negotiated, addresses[res.num], res.timings, nil
+	}
+	return nil, nil, "", timings, addressesError(addresses, errs)
+}
+
+// fallbackUsed rings a 'general' alert when the primary address of the
+// host is down and a fallback address is used (only once, until the
+// primary address is back, see primaryUsed)
+func (connection *Connection) fallbackUsed(addr string, primaryErr error) {
+	primary := connection.Addresses()[0]
+	Info.Printf("primary address %s of '%s' failed (%s), using %s", primary, connection.hostName, primaryErr, addr)
+
+	hash := fallbackFailHash(connection.hostName)
+	if CurrentFailsLoaded() == false || CurrentFailExists(hash) {
+		return
+	}
+	currentFail := CurrentFailGetAndInc(hash)
+	currentFail.Host = connection.hostName
+
+	var details bytes.Buffer
+
+	details.WriteString("\n")
+	details.WriteString("Primary address: " + primary + "\n")
+	details.WriteString("Error: " + primaryErr.Error() + "\n")
+	details.WriteString("Answering address: " + addr + "\n")
+
+	message := AlertMessageCreateForConnection(AlertBad, connection.hostName, fmt.Sprintf("primary address %s is down, using %s", primary, addr), "Only a fallback address of this host is answering.", details.String(), currentFail.UniqueID)
+	message.RingAlerts()
+}
+
+// primaryUsed rings a 'general' GOOD alert if the primary address of
+// the host is back (see fallbackUsed)
+func (connection *Connection) primaryUsed() {
+	if CurrentFailsLoaded() == false {
+		return
+	}
+	hash := fallbackFailHash(connection.hostName)
+	currentFail := CurrentFailGet(hash)
+	if currentFail == nil {
+		return
+	}
+	CurrentFailDelete(hash)
+
+	primary := connection.Addresses()[0]
+	message := AlertMessageCreateForConnection(AlertGood, connection.hostName, fmt.Sprintf("primary address %s is up again", primary), "The primary address of this host is answering again.", "", currentFail.UniqueID)
+	message.RingAlerts()
+}
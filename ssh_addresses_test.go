@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServers starts an SSH server (no authentication) on each of the
+// given loopback addresses, all on the same port, waiting for its delay
+// before the handshake. A negative delay is a down address (nothing
+// listening). It returns the port and a function waiting for the end of
+// every accepted connection.
+func testSSHServers(t *testing.T, hosts []string, delays []time.Duration) (int, func()) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	var (
+		mutex   sync.Mutex
+		pending int
+	)
+	port := 0
+	for num, host := range hosts {
+		listener, err := net.Listen("tcp", hostPortAddress(host, port))
+		if err != nil {
+			t.Skipf("can't listen on %s: %s", host, err)
+		}
+		port = listener.Addr().(*net.TCPAddr).Port
+		if delays[num] < 0 {
+			listener.Close()
+			continue
+		}
+		t.Cleanup(func() { listener.Close() })
+
+		go func(delay time.Duration) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				mutex.Lock()
+				pending++
+				mutex.Unlock()
+				go func() {
+					defer func() {
+						conn.Close()
+						mutex.Lock()
+						pending--
+						mutex.Unlock()
+					}()
+					time.Sleep(delay)
+					sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+					if err != nil {
+						return
+					}
+					go ssh.DiscardRequests(reqs)
+					go func() {
+						for ch := range chans {
+							ch.Reject(ssh.Prohibited, "test server")
+						}
+					}()
+					sconn.Wait()
+				}()
+			}
+		}(delays[num])
+	}
+	wait := func() {
+		for {
+			mutex.Lock()
+			done := (pending == 0)
+			mutex.Unlock()
+			if done == true {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return port, wait
+}
+
+func TestDialAddresses(t *testing.T) {
+	const (
+		down = -1
+		fast = 0
+		slow = 300 * time.Millisecond
+	)
+	hosts := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+
+	tests := []struct {
+		name     string
+		mode     string
+		delays   []time.Duration
+		answered int // index of the answering address, -1 if none
+		fallback bool
+	}{
+		{"failover, primary up", HostsFailover, []time.Duration{fast, fast}, 0, false},
+		{"failover, slow primary", HostsFailover, []time.Duration{slow, fast}, 0, false},
+		{"failover, primary down", HostsFailover, []time.Duration{down, fast}, 1, true},
+		{"failover, in order", HostsFailover, []time.Duration{down, slow, fast}, 1, true},
+		{"failover, all down", HostsFailover, []time.Duration{down, down}, -1, false},
+		{"race, fastest", HostsRace, []time.Duration{slow, fast}, 1, false},
+		{"race, fast primary", HostsRace, []time.Duration{fast, slow}, 0, false},
+		{"race, primary down", HostsRace, []time.Duration{down, slow, fast}, 2, true},
+		{"race, all down", HostsRace, []time.Duration{down, down, down}, -1, false},
+		{"single address", HostsRace, []time.Duration{fast}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alerts := testAlertsSetup(t)
+			addresses := hosts[:len(test.delays)]
+			port, serversWait := testSSHServers(t, addresses, test.delays)
+
+			connection := &Connection{
+				User:           "test",
+				Host:           addresses[0],
+				Hosts:          addresses,
+				HostsMode:      test.mode,
+				Port:           port,
+				ConnectTimeout: 5 * time.Second,
+				hostName:       "h",
+			}
+			sshConfig := &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+			client, _, addr, _, err := connection.dialAddresses(nil, sshConfig)
+			if test.answered < 0 {
+				if err == nil {
+					client.Close()
+					t.Fatalf("%s answered, all addresses are down", addr)
+				}
+				if len(addresses) > 1 && strings.HasPrefix(err.Error(), "no address answered") == false {
+					t.Errorf("error is '%s', want a list of failed addresses", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+
+			if want := hostPortAddress(addresses[test.answered], port); addr != want {
+				t.Errorf("answered address is %s, want %s", addr, want)
+			}
+
+			// raced addresses are checked (closed) in the background
+			serversWait()
+			hash := fallbackFailHash(connection.hostName)
+			deadline := time.Now().Add(5 * time.Second)
+			for CurrentFailExists(hash) != test.fallback && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if CurrentFailExists(hash) != test.fallback {
+				t.Errorf("fallback address fail = %t, want %t", !test.fallback, test.fallback)
+			}
+			if subjects := alerts(); test.fallback && len(subjects) != 1 {
+				t.Errorf("alerts: %q, want one fallback address alert", subjects)
+			}
+		})
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	connection := &Connection{Hosts: []string{"10.0.0.1", "::1", "host.example.com"}, Port: 2222}
+	want := []string{"10.0.0.1:2222", "[::1]:2222", "host.example.com:2222"}
+	got := connection.Addresses()
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("addresses are %q, want %q", got, want)
+	}
+
+	// a single address keeps its own error
+	single := addressesError([]string{"a:22"}, []error{net.ErrClosed})
+	if single != net.ErrClosed {
+		t.Errorf("error is '%s', want '%s'", single, net.ErrClosed)
+	}
+	errs := []error{net.ErrClosed, nil, net.ErrWriteToConnected}
+	list := addressesError([]string{"a:22", "b:22", "c:22"}, errs).Error()
+	for num, addr := range []string{"a:22", "b:22", "c:22"} {
+		if strings.Contains(list, addr+": ") != (errs[num] != nil) {
+			t.Errorf("error '%s': address %s listed = %t", list, addr, !(errs[num] != nil))
+		}
+	}
+}
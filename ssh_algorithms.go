@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHAlgorithms lists algorithms allowed for an SSH connection, in
+// preference order (x/crypto/ssh defaults are used for empty lists)
+type SSHAlgorithms struct {
+	Ciphers           []string
+	KeyExchanges      []string
+	MACs              []string
+	HostKeyAlgorithms []string
+}
+
+// algorithms supported by x/crypto/ssh (client side), including
+// insecure ones for old appliances
+var (
+	supportedSSHCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	supportedSSHKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+	supportedSSHMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+	supportedSSHHostKeyAlgorithms = []string{
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+		ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+		ssh.KeyAlgoED25519,
+	}
+
+	// these ciphers provide their own integrity, no MAC is used
+	sshAEADCiphers = []string{"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com"}
+)
+
+func checkSSHAlgorithmNames(param string, names []string, supported []string) error {
+	for _, name := range names {
+		if StringInSlice(name, supported) == false {
+			return fmt.Errorf("invalid '%s' value '%s' (supported: %s)", param, name, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// Check returns an error if any algorithm is not supported
+func (algos *SSHAlgorithms) Check() error {
+	if err := checkSSHAlgorithmNames("ciphers", algos.Ciphers, supportedSSHCiphers); err != nil {
+		return err
+	}
+	if err := checkSSHAlgorithmNames("key_exchanges", algos.KeyExchanges, supportedSSHKeyExchanges); err != nil {
+		return err
+	}
+	if err := checkSSHAlgorithmNames("macs", algos.MACs, supportedSSHMACs); err != nil {
+		return err
+	}
+	if err := checkSSHAlgorithmNames("host_key_algorithms", algos.HostKeyAlgorithms, supportedSSHHostKeyAlgorithms); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SSHNegotiated holds algorithms negotiated by the client and the server
+// for an SSH connection
+type SSHNegotiated struct {
+	KeyExchange string
+	HostKey     string
+	Cipher      string
+	MAC         string
+}
+
+func (neg *SSHNegotiated) String() string {
+	return fmt.Sprintf("kex: %s, host key: %s, cipher: %s, MAC: %s", neg.KeyExchange, neg.HostKey, neg.Cipher, neg.MAC)
+}
+
+// sshKexInit is the SSH_MSG_KEXINIT message (RFC 4253, section 7.1)
+type sshKexInit struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// kexInitRecorder is a net.Conn recording the beginning of the stream in
+// both directions (up to the first KEXINIT packet, sent in clear), so we
+// can find which algorithms were negotiated
+type kexInitRecorder struct {
+	net.Conn
+
+	mutex   sync.Mutex
+	read    bytes.Buffer
+	written bytes.Buffer
+}
+
+// maxKexInitRecord limits the recording, in case of a strange server
+const maxKexInitRecord = 64 * 1024
+
+func (rec *kexInitRecorder) Read(b []byte) (int, error) {
+	n, err := rec.Conn.Read(b)
+	rec.record(&rec.read, b[:n])
+	return n, err
+}
+
+func (rec *kexInitRecorder) Write(b []byte) (int, error) {
+	rec.record(&rec.written, b)
+	return rec.Conn.Write(b)
+}
+
+func (rec *kexInitRecorder) record(buf *bytes.Buffer, b []byte) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if buf.Len() >= maxKexInitRecord {
+		return
+	}
+	if _, err := parseKexInit(buf.Bytes()); err == nil {
+		return // already complete
+	}
+	buf.Write(b)
+}
+
+// parseKexInit parses the first KEXINIT packet following the SSH
+// identification string (and optional banner lines) of the stream
+func parseKexInit(stream []byte) (*sshKexInit, error) {
+	for {
+		i := bytes.IndexByte(stream, '\n')
+		if i < 0 {
+			return nil, fmt.Errorf("no SSH identification string")
+		}
+		line := stream[:i]
+		stream = stream[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	if len(stream) < 5 {
+		return nil, fmt.Errorf("no complete KEXINIT packet")
+	}
+	length := binary.BigEndian.Uint32(stream[0:4])
+	padding := uint32(stream[4])
+	if length < padding+1 || uint32(len(stream)-4) < length {
+		return nil, fmt.Errorf("no complete KEXINIT packet")
+	}
+
+	var msg sshKexInit
+	if err := ssh.Unmarshal(stream[5:4+length-padding], &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// firstCommon returns the first client algorithm supported by the server
+func firstCommon(client []string, server []string) string {
+	for _, c := range client {
+		if StringInSlice(c, server) {
+			return c
+		}
+	}
+	return "none"
+}
+
+// Negotiated returns algorithms negotiated during the key exchange
+// (using the same rules as RFC 4253, section 7.1)
+func (rec *kexInitRecorder) Negotiated() (*SSHNegotiated, error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	client, err := parseKexInit(rec.written.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("client KEXINIT: %s", err)
+	}
+	server, err := parseKexInit(rec.read.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("server KEXINIT: %s", err)
+	}
+
+	var neg SSHNegotiated
+	neg.KeyExchange = firstCommon(client.KexAlgos, server.KexAlgos)
+	neg.HostKey = firstCommon(client.ServerHostKeyAlgos, server.ServerHostKeyAlgos)
+	neg.Cipher = firstCommon(client.CiphersClientServer, server.CiphersClientServer)
+	neg.MAC = firstCommon(client.MACsClientServer, server.MACsClientServer)
+	if StringInSlice(neg.Cipher, sshAEADCiphers) {
+		neg.MAC = "implicit"
+	}
+	return &neg, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHDialTimings stores the duration of each phase of an SSH connection
+// (DNS is resolved by the jump host when there's one)
+type SSHDialTimings struct {
+	DNS       time.Duration
+	TCP       time.Duration
+	Handshake time.Duration
+	Auth      time.Duration
+}
+
+func (timings *SSHDialTimings) String() string {
+	return fmt.Sprintf("DNS: %s, TCP: %s, handshake: %s, auth: %s", timings.DNS, timings.TCP, timings.Handshake, timings.Auth)
+}
+
+// dialTCP opens the TCP connection to addr, directly or through an
+// existing SSH client if via is not nil
+func dialTCP(via *ssh.Client, addr string, deadline time.Time, timings *SSHDialTimings) (net.Conn, error) {
+	if via != nil {
+		type dialResult struct {
+			conn net.Conn
+			err  error
+		}
+
+		start := time.Now()
+		result := make(chan dialResult, 1)
+		go func() {
+			conn, err := via.Dial("tcp", addr)
+			result <- dialResult{conn, err}
+		}()
+
+		select {
+		case res := <-result:
+			timings.TCP = time.Now().Sub(start)
+			if res.err != nil {
+				if strings.Contains(res.err.Error(), "refused") {
+					return nil, fmt.Errorf("port closed (%s)", addr)
+				}
+				return nil, fmt.Errorf("TCP connect failed (%s): %s", addr, res.err)
+			}
+			return res.conn, nil
+		case <-time.After(time.Until(deadline)):
+			timings.TCP = time.Now().Sub(start)
+			go func() {
+				if res := <-result; res.conn != nil {
+					res.conn.Close()
+				}
+			}()
+			return nil, fmt.Errorf("TCP connect timeout (%s, after %s)", addr, timings.TCP.Round(time.Millisecond))
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	timings.DNS = time.Now().Sub(start)
+	if err != nil {
+		return nil, fmt.Errorf("DNS failed for '%s': %s", host, err)
+	}
+
+	var (
+		dialer net.Dialer
+		conn   net.Conn
+	)
+	start = time.Now()
+	for _, ip := range ips {
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			break
+		}
+	}
+	timings.TCP = time.Now().Sub(start)
+
+	switch {
+	case err == nil:
+		return conn, nil
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return nil, fmt.Errorf("port closed (%s)", addr)
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("TCP connect timeout (%s, after %s)", addr, timings.TCP.Round(time.Millisecond))
+	}
+	return nil, fmt.Errorf("TCP connect failed (%s): %s", addr, err)
+}
+
+// sshDialVia dials an SSH server directly, or through an existing SSH
+// client if via is not nil. The whole connection (DNS, TCP, handshake
+// and authentication) can't last more than timeout. Negotiated
+// algorithms are returned too (or nil if they can't be found), and the
+// duration of each phase.
+func sshDialVia(via *ssh.Client, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, *SSHNegotiated, *SSHDialTimings, error) {
+	var timings SSHDialTimings
+	deadline := time.Now().Add(timeout)
+
+	conn, err := dialTCP(via, addr, deadline, &timings)
+	if err != nil {
+		return nil, nil, &timings, err
+	}
+
+	// the handshake is over once the host key is checked, then the
+	// authentication follows
+	var (
+		hostKeyChecked bool
+		hostKeyErr     error
+	)
+	phaseStart := time.Now()
+	sshConfig := *config
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		timings.Handshake = time.Now().Sub(phaseStart)
+		hostKeyErr = config.HostKeyCallback(hostname, remote, key)
+		hostKeyChecked = true
+		phaseStart = time.Now()
+		return hostKeyErr
+	}
+
+	// deadlines are not supported by connections through jump hosts,
+	// so the connection is simply closed
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		conn.Close()
+	})
+
+	rec := &kexInitRecorder{Conn: conn}
+	c, chans, reqs, err := ssh.NewClientConn(rec, addr, &sshConfig)
+	timedOut := (timer.Stop() == false)
+	if err != nil {
+		conn.Close()
+		elapsed := time.Now().Sub(phaseStart)
+		if hostKeyChecked == false || hostKeyErr != nil {
+			if hostKeyChecked == false {
+				timings.Handshake = elapsed
+			}
+			if timedOut == true {
+				return nil, nil, &timings, fmt.Errorf("slow handshake (%s, no answer after %s)", addr, timeout)
+			}
+			return nil, nil, &timings, fmt.Errorf("SSH handshake failed (%s): %s", addr, err)
+		}
+
+		timings.Auth = elapsed
+		if timedOut == true {
+			return nil, nil, &timings, fmt.Errorf("slow authentication (%s, no answer after %s)", addr, timeout)
+		}
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, nil, &timings, fmt.Errorf("auth rejected (%s, user '%s'): %s", addr, config.User, err)
+		}
+		return nil, nil, &timings, fmt.Errorf("SSH authentication failed (%s): %s", addr, err)
+	}
+	timings.Auth = time.Now().Sub(phaseStart)
+
+	negotiated, err := rec.Negotiated()
+	if err != nil {
+		Trace.Printf("can't find negotiated algorithms for %s: %s", addr, err)
+	}
+	return ssh.NewClient(c, chans, reqs), negotiated, &timings, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHop is a jump host (bastion) used to reach a host
+type JumpHop struct {
+	Name       string
+	User       string
+	Host       string
+	Port       int
+	Algorithms SSHAlgorithms
+	Auths      []ssh.AuthMethod
+	KnownHosts string // empty: known_hosts of the host using this hop
+
+	confHash string
+}
+
+func (hop *JumpHop) String() string {
+	return fmt.Sprintf("%s@%s", hop.User, hostPortAddress(hop.Host, hop.Port))
+}
+
+// jumpClient is an SSH connection to a jump host, shared by every host
+// using the same chain of jump hosts. It's closed when no host is
+// using it anymore.
+type jumpClient struct {
+	mutex  sync.Mutex
+	client *ssh.Client
+	refs   int
+}
+
+var (
+	jumpClients      = make(map[string]*jumpClient)
+	jumpClientsMutex sync.Mutex
+)
+
+func getJumpClient(key string) *jumpClient {
+	jumpClientsMutex.Lock()
+	defer jumpClientsMutex.Unlock()
+
+	jc, exists := jumpClients[key]
+	if exists == false {
+		jc = &jumpClient{}
+		jumpClients[key] = jc
+	}
+	return jc
+}
+
+// acquire returns the SSH client of this jump host, dialing it (through
+// the via client, if not nil) if needed
+func (jc *jumpClient) acquire(hop *JumpHop, via *ssh.Client, knownHosts string, timeout time.Duration) (*ssh.Client, error) {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	if jc.client == nil {
+		addr := hostPortAddress(hop.Host, hop.Port)
+		client, _, _, err := sshDialVia(via, addr, sshClientConfig(hop.User, hop.Auths, &hop.Algorithms, knownHosts), timeout)
+		if err != nil {
+			return nil, err
+		}
+		Trace.Printf("SSH jump connection to %s\n", hop)
+		jc.client = client
+
+		// forget the client as soon as it's closed (or dead)
+		go func() {
+			client.Wait()
+			jc.mutex.Lock()
+			if jc.client == client {
+				jc.client = nil
+			}
+			jc.mutex.Unlock()
+		}()
+	}
+
+	jc.refs++
+	return jc.client, nil
+}
+
+func (jc *jumpClient) release() {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	jc.refs--
+	if jc.refs == 0 && jc.client != nil {
+		jc.client.Close()
+		jc.client = nil
+	}
+}
+
+// dialJumps connects (or re-uses connections) to every jump host of the
+// chain, and returns the client of the last one. The release function
+// must be called when this client is not needed anymore. Host keys
+// are checked using the known_hosts file of each jump host (the given one
+// if it has none), and the connection to each jump host must not last
+// more than timeout.
+func dialJumps(hops []*JumpHop, knownHosts string, timeout time.Duration) (*ssh.Client, func(), error) {
+	var (
+		via      *ssh.Client
+		acquired []*jumpClient
+		chain    []string
+	)
+
+	release := func() {
+		for i := len(acquired) - 1; i >= 0; i-- {
+			acquired[i].release()
+		}
+	}
+
+	for _, hop := range hops {
+		chain = append(chain, hop.String())
+		jc := getJumpClient(strings.Join(chain, " > "))
+
+		hopKnownHosts := knownHosts
+		if hop.KnownHosts != "" {
+			hopKnownHosts = hop.KnownHosts
+		}
+		client, err := jc.acquire(hop, via, hopKnownHosts, timeout)
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("jump host '%s' (%s): %s", hop.Name, hop, err)
+		}
+		acquired = append(acquired, jc)
+		via = client
+	}
+
+	return via, release, nil
+}
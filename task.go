@@ -14,13 +14,77 @@ type Task struct {
 	//~ RemainingTicks int
 	NextRun time.Time
 	PrevRun time.Time
+
+	// tasks of the same host this one depends on (see probe depends_on)
+	DependsOn []*Task
 }
 
 // ReSchedule is used to schedule another run for this
-// task in the future
-func (task *Task) ReSchedule(val time.Time) {
+// task in the future, computing the next run time (after the given time)
+// with the probe delay or schedule
+func (task *Task) ReSchedule(from time.Time) {
 	task.PrevRun = task.NextRun
-	task.NextRun = val
+	task.NextRun = task.Probe.NextRunAfter(from)
+}
+
+// RetryDelay is the maximum delay before trying again a failed or
+// paused task
+const RetryDelay = time.Minute
+
+// Retry schedules the task again after RetryDelay (or the probe delay, if
+// shorter), without changing PrevRun. Scheduled probes (cron) always use
+// RetryDelay.
+func (task *Task) Retry(from time.Time) {
+	delay := RetryDelay
+	if task.Probe.Delay > 0 && task.Probe.Delay < delay {
+		delay = task.Probe.Delay
+	}
+	task.NextRun = from.Add(delay)
+}
+
+// Postpone schedules a task that was not run (paused, skipped, …): at
+// the next scheduled time for cron probes, or using Retry otherwise
+func (task *Task) Postpone(from time.Time) {
+	if task.Probe.Schedule != nil {
+		task.NextRun = task.Probe.NextRunAfter(from)
+		return
+	}
+	task.Retry(from)
+}
+
+// Failing returns true if this task currently has a task error or a
+// (confirmed) failed check on the named host
+func (task *Task) Failing(hostName string) bool {
+	if CurrentTaskFailExists(task) {
+		return true
+	}
+	for _, check := range task.Probe.Checks {
+		hash := checkFailHash(hostName, task.Probe.Name, check, "")
+		if cf := CurrentFailGet(hash); cf != nil && cf.FailCount >= check.NeededFailures {
+			return true
+		}
+		for _, cf := range CurrentCheckInstanceFails(hash) {
+			if cf.FailCount >= check.NeededFailures {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FailingDependency returns the name of the first probe this task depends
+// on (directly or not) that is currently failing on the named host, or an
+// empty string if all dependencies are OK
+func (task *Task) FailingDependency(hostName string) string {
+	for _, dep := range task.DependsOn {
+		if dep.Failing(hostName) {
+			return dep.Probe.Name
+		}
+		if name := dep.FailingDependency(hostName); name != "" {
+			return name
+		}
+	}
+	return ""
 }
 
 // Taskable returns true if the task is currently available (see RunIf expression)
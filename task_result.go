@@ -1,9 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"regexp"
-	"strconv"
 	"time"
 )
 
@@ -12,13 +12,41 @@ type TaskResult struct {
 	Task             *Task
 	Host             *Host
 	Values           map[string]string
+	Labels           []string                     // instance labels, in output order
+	LabelledValues   map[string]map[string]string // label -> name -> value
+	Structured       map[string]interface{}       // arrays and objects (JSON output)
 	ExitStatus       int
 	StartTime        time.Time
 	Duration         time.Duration
 	Logs             []string // currently, only output # lines
 	Errors           []error
-	FailedChecks     []*Check
-	SuccessfulChecks []*Check
+	FailedChecks     []*CheckResult
+	SuccessfulChecks []*CheckResult
+	State            string // see __STATE
+
+	stateSet  bool
+	rawOutput bytes.Buffer // script output, for JSON and Nagios probes
+}
+
+// CheckResult is a Check evaluated for a TaskResult, once per instance
+// label if the check uses labelled values (see TaskResult.Labels)
+type CheckResult struct {
+	Check *Check
+	Label string // empty if not a per-instance check
+	Text  string // see Check.TextValue
+}
+
+// Desc returns the check description, with the instance label and the
+// text (if any)
+func (res *CheckResult) Desc() string {
+	desc := res.Check.Desc
+	if res.Text != "" {
+		desc = fmt.Sprintf("%s: %s", desc, res.Text)
+	}
+	if res.Label == "" {
+		return desc
+	}
+	return fmt.Sprintf("%s (%s)", desc, res.Label)
 }
 
 func (result *TaskResult) addError(err error) {
@@ -31,6 +59,43 @@ func (result *TaskResult) addLog(line string) {
 	result.Logs = append(result.Logs, line)
 }
 
+// addLabelledValue stores a NAME[label] value
+func (result *TaskResult) addLabelledValue(name string, label string, value string) error {
+	values, exists := result.LabelledValues[label]
+	if exists == false {
+		values = make(map[string]string)
+		result.LabelledValues[label] = values
+		result.Labels = append(result.Labels, label)
+	}
+	if _, exists := values[name]; exists == true {
+		return fmt.Errorf("parameter '%s[%s]' defined multiple times", name, label)
+	}
+	values[name] = value
+	return nil
+}
+
+// isLabelled returns true if the named value was given with a label
+func (result *TaskResult) isLabelled(name string) bool {
+	for _, values := range result.LabelledValues {
+		if _, exists := values[name]; exists == true {
+			return true
+		}
+	}
+	return false
+}
+
+// labelledVars returns labelled values used by the check (if any, the
+// check is evaluated once per label, see Probe.Labelled)
+func (result *TaskResult) labelledVars(check *Check) []string {
+	var vars []string
+	for _, name := range check.If.Vars() {
+		if result.Task.Probe.IsLabelled(name) {
+			vars = append(vars, name)
+		}
+	}
+	return vars
+}
+
 // DoChecks evaluates every Check in the TaskResult and fills
 // FailedChecks and SuccessfulChecks arrays
 func (result *TaskResult) DoChecks() {
@@ -38,22 +103,10 @@ func (result *TaskResult) DoChecks() {
 	params := make(map[string]interface{})
 
 	for key, val := range result.Values {
-		var err error
-		if match, _ := regexp.MatchString("^[0-9]+$", val); match == true {
-			params[key], err = strconv.Atoi(val)
-			if err != nil {
-				result.addError(fmt.Errorf("can't convert '%s' to an int (%s)", val, err))
-			}
-			continue
-		}
-		if match, _ := regexp.MatchString("^[0-9]+\\.[0-9]+$", val); match == true {
-			params[key], err = strconv.ParseFloat(val, 64)
-			if err != nil {
-				result.addError(fmt.Errorf("can't convert '%s' to a float64 (%s)", val, err))
-			}
-			continue
-		}
-		// string
+		params[key], _ = ParseValue(val)
+	}
+
+	for key, val := range result.Structured {
 		params[key] = val
 	}
 
@@ -67,21 +120,190 @@ func (result *TaskResult) DoChecks() {
 	}
 
 	for _, check := range result.Task.Probe.Checks {
-		res, err := check.If.Evaluate(params)
-		Trace.Printf("%s: %t (err: %s)\n", check.Desc, res, err)
-		if err != nil {
-			result.addError(fmt.Errorf("%s (expression '%s' in '%s' check)", err, check.If, check.Desc))
+		labelled := result.labelledVars(check)
+		if check.Implicit == true && len(labelled) == 0 && result.missingValues(check) {
 			continue
 		}
-		if _, ok := res.(bool); ok == false {
-			result.addError(fmt.Errorf("[[check]] 'if' must return a boolean value (expression '%s' in '%s' check)", check.If, check.Desc))
+		if len(labelled) == 0 {
+			result.doCheck(&CheckResult{Check: check}, result.Values, params)
 			continue
 		}
 
-		if res == true {
-			result.FailedChecks = append(result.FailedChecks, check)
-		} else {
-			result.SuccessfulChecks = append(result.SuccessfulChecks, check)
+		for _, label := range result.Labels {
+			values := result.LabelledValues[label]
+			var missing []string
+			for _, name := range labelled {
+				if _, exists := values[name]; exists == false {
+					missing = append(missing, name)
+				}
+			}
+			// not a label of the values used by the check (a script may
+			// output different families of labelled values)
+			if len(missing) == len(labelled) {
+				continue
+			}
+			for _, name := range missing {
+				result.addError(fmt.Errorf("no value for %s[%s] (expression '%s' in '%s' check)", name, label, check.If, check.Desc))
+			}
+			if len(missing) > 0 {
+				continue
+			}
+
+			instValues := make(map[string]string)
+			instParams := make(map[string]interface{})
+			for key, val := range result.Values {
+				instValues[key] = val
+			}
+			for key, val := range params {
+				instParams[key] = val
+			}
+			for key, val := range values {
+				instValues[key] = val
+				instParams[key], _ = ParseValue(val)
+			}
+			result.doCheck(&CheckResult{Check: check, Label: label}, instValues, instParams)
+		}
+	}
+}
+
+// missingValues returns true if a script value used by the check is
+// missing
+func (result *TaskResult) missingValues(check *Check) bool {
+	for _, name := range check.If.Vars() {
+		if !IsAllUpper(name) {
+			continue
+		}
+		if _, exists := result.Values[name]; exists == false {
+			return true
 		}
 	}
+	return false
+}
+
+// doCheck evaluates a check with given script values and parameters
+func (result *TaskResult) doCheck(checkRes *CheckResult, values map[string]string, params map[string]interface{}) {
+	check := checkRes.Check
+	if check.TextValue != "" {
+		checkRes.Text = values[check.TextValue]
+	}
+
+	checkParams, err := checkParams(check, values, params)
+	if err != nil {
+		result.addError(fmt.Errorf("%s (expression '%s' in '%s' check)", err, check.If, checkRes.Desc()))
+		return
+	}
+
+	res, err := check.If.Evaluate(checkParams)
+	Trace.Printf("%s: %t (err: %s)\n", checkRes.Desc(), res, err)
+	if err != nil {
+		result.addError(fmt.Errorf("%s (expression '%s' in '%s' check)", err, check.If, checkRes.Desc()))
+		return
+	}
+	if _, ok := res.(bool); ok == false {
+		result.addError(fmt.Errorf("[[check]] 'if' must return a boolean value (expression '%s' in '%s' check)", check.If, checkRes.Desc()))
+		return
+	}
+
+	if res == true {
+		result.FailedChecks = append(result.FailedChecks, checkRes)
+	} else {
+		result.SuccessfulChecks = append(result.SuccessfulChecks, checkRes)
+	}
+}
+
+// checkParams returns parameters for the check, where script values are
+// converted to the type expected by the check (params are returned as-is
+// for "auto" type checks)
+func checkParams(check *Check, values map[string]string, params map[string]interface{}) (map[string]interface{}, error) {
+	if check.Type == ValueAuto {
+		return params, nil
+	}
+
+	checkParams := make(map[string]interface{})
+	for key, val := range params {
+		checkParams[key] = val
+	}
+
+	for _, name := range check.If.Vars() {
+		val, exists := values[name]
+		if exists == false {
+			continue
+		}
+		typed, err := TypedValue(val, check.Type)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		checkParams[name] = typed
+	}
+	return checkParams, nil
+}
+
+// goneInstances returns currently failing instances of the check that
+// were not evaluated in this result (no longer reported by the script).
+// If the check is evaluated per instance, its failure as a whole (from
+// a time when its values were not labelled) is gone too.
+func (result *TaskResult) goneInstances(hostName string, check *Check) []*CheckResult {
+	evaluated := make(map[string]bool)
+	for _, checks := range [][]*CheckResult{result.FailedChecks, result.SuccessfulChecks} {
+		for _, checkRes := range checks {
+			if checkRes.Check == check {
+				evaluated[checkRes.Label] = true
+			}
+		}
+	}
+
+	var gone []*CheckResult
+	checkHash := checkFailHash(hostName, result.Task.Probe.Name, check, "")
+	if len(result.labelledVars(check)) > 0 && CurrentFailExists(checkHash) {
+		Trace.Printf("check '%s' is now evaluated per instance (%s)", check.Desc, hostName)
+		gone = append(gone, &CheckResult{Check: check})
+	}
+	for _, cf := range CurrentCheckInstanceFails(checkHash) {
+		if evaluated[cf.Label] == false {
+			Trace.Printf("instance '%s' of check '%s' no longer reported (%s)", cf.Label, check.Desc, hostName)
+			gone = append(gone, &CheckResult{Check: check, Label: cf.Label})
+		}
+	}
+	return gone
+}
+
+// Value returns the named script value, for the given instance label (a
+// labelled value) or not
+func (result *TaskResult) Value(name string, label string) string {
+	if values, exists := result.LabelledValues[label]; exists == true {
+		if val, exists := values[name]; exists == true {
+			return val
+		}
+	}
+	if val, exists := result.Structured[name]; exists == true {
+		return jsonString(val)
+	}
+	return result.Values[name]
+}
+
+// AllValues returns every script value of the result, labelled ones
+// being named NAME[label]
+func (result *TaskResult) AllValues() map[string]string {
+	all := make(map[string]string)
+	for key, val := range result.Values {
+		all[key] = val
+	}
+	for label, values := range result.LabelledValues {
+		for key, val := range values {
+			all[key+"["+label+"]"] = val
+		}
+	}
+	for key, val := range result.Structured {
+		all[key] = jsonString(val)
+	}
+	return all
+}
+
+// jsonString returns the compact JSON form of a structured value
+func jsonString(val interface{}) string {
+	str, err := json.Marshal(val)
+	if err != nil {
+		return "INVALID_JSON"
+	}
+	return string(str)
 }
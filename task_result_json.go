@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// jsonLogsKey is the reserved key of JSON outputs holding logs
+const jsonLogsKey = "logs"
+
+// jsonArray is a JSON array given to checks: govaluate would spread a
+// plain []interface{} as function arguments (see "get" check function)
+type jsonArray []interface{}
+
+// jsonPathKey returns the JSON path of key in the parent path
+func jsonPathKey(path string, key string) string {
+	return path + "." + key
+}
+
+// jsonPathIndex returns the JSON path of index in the parent path
+func jsonPathIndex(path string, index int) string {
+	return path + "[" + strconv.Itoa(index) + "]"
+}
+
+// jsonSyntaxPosition returns "line L, column C" of the offset in data
+func jsonSyntaxPosition(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
+
+// parseJSONOutput parses the JSON document printed by a probe script:
+// top-level scalars become Values, arrays and objects are available to
+// checks as they are (see Structured), and a "logs" array of strings
+// feeds Logs. Errors give the JSON path of the faulty value.
+func (result *TaskResult) parseJSONOutput(data []byte) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		result.addError(errors.New("JSON output: empty output"))
+		return
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// the offset is after the faulty character
+			result.addError(fmt.Errorf("JSON output: %s (%s)", err, jsonSyntaxPosition(data, syntaxErr.Offset-1)))
+			return
+		}
+		result.addError(fmt.Errorf("JSON output: %s", err))
+		return
+	}
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		trailing := len(data[end:]) - len(bytes.TrimLeft(data[end:], " \t\r\n"))
+		result.addError(fmt.Errorf("JSON output: unexpected data after the document (%s)", jsonSyntaxPosition(data, end+int64(trailing))))
+		return
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if ok == false {
+		result.addError(errors.New("JSON output: $: the document must be an object"))
+		return
+	}
+
+	for key, val := range obj {
+		path := jsonPathKey("$", key)
+
+		if key == jsonLogsKey {
+			result.addJSONLogs(path, val)
+			continue
+		}
+
+		if !IsValidTokenName(key) {
+			result.addError(fmt.Errorf("JSON output: %s: invalid parameter name (not a valid token name)", path))
+			continue
+		}
+		if !IsAllUpper(key) {
+			result.addError(fmt.Errorf("JSON output: %s: invalid parameter name (upper case needed)", path))
+			continue
+		}
+
+		switch v := val.(type) {
+		case nil:
+			result.addError(fmt.Errorf("JSON output: %s: null value", path))
+		case string:
+			if len(v) == 0 {
+				result.addError(fmt.Errorf("JSON output: %s: empty value", path))
+				continue
+			}
+			result.Values[key] = v
+		case json.Number:
+			result.Values[key] = v.String()
+		case bool:
+			result.Values[key] = strconv.FormatBool(v)
+		default:
+			structured, err := jsonToParam(path, val)
+			if err != nil {
+				result.addError(fmt.Errorf("JSON output: %s", err))
+				continue
+			}
+			result.Structured[key] = structured
+		}
+	}
+}
+
+// addJSONLogs adds every string of the "logs" array to Logs
+func (result *TaskResult) addJSONLogs(path string, val interface{}) {
+	logs, ok := val.([]interface{})
+	if ok == false {
+		result.addError(fmt.Errorf("JSON output: %s: must be an array of strings", path))
+		return
+	}
+	for index, log := range logs {
+		str, ok := log.(string)
+		if ok == false {
+			result.addError(fmt.Errorf("JSON output: %s: log must be a string", jsonPathIndex(path, index)))
+			continue
+		}
+		result.addLog(str)
+	}
+}
+
+// jsonToParam converts a decoded JSON value to a check parameter: numbers
+// become float64 (as every govaluate number), arrays (as jsonArray) and
+// objects are converted recursively
+func jsonToParam(path string, val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case json.Number:
+		num, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid number '%s'", path, v)
+		}
+		return num, nil
+	case []interface{}:
+		list := make(jsonArray, len(v))
+		for index, item := range v {
+			param, err := jsonToParam(jsonPathIndex(path, index), item)
+			if err != nil {
+				return nil, err
+			}
+			list[index] = param
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := make(map[string]interface{})
+		for key, item := range v {
+			param, err := jsonToParam(jsonPathKey(path, key), item)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = param
+		}
+		return obj, nil
+	}
+	// string, bool, nil
+	return val, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		values map[string]string
+		logs   []string
+		err    string // contained by the only error, if any
+	}{
+		{`{"A": 1, "B": "x y", "C": true, "D": -1.5e3}`, map[string]string{"A": "1", "B": "x y", "C": "true", "D": "-1.5e3"}, nil, ""},
+		{`{"A": 1, "logs": ["one", "two"]}`, map[string]string{"A": "1"}, []string{"one", "two"}, ""},
+		{"  \n", nil, nil, "JSON output: empty output"},
+		{"{\n\"A\": 1,\n}", nil, nil, "(line 3, column 1)"},
+		{"{\"A\": 1 \"B\": 2}", nil, nil, "(line 1, column 9)"},
+		{"x", nil, nil, "(line 1, column 1)"},
+		{"{\"A\": 1}\n {\"B\": 2}", nil, nil, "unexpected data after the document (line 2, column 2)"},
+		{`[1, 2]`, nil, nil, "$: the document must be an object"},
+		{`{"A": 1, "B-C": 2}`, map[string]string{"A": "1"}, nil, "$.B-C: invalid parameter name (not a valid token name)"},
+		{`{"A": 1, "b": 2}`, map[string]string{"A": "1"}, nil, "$.b: invalid parameter name (upper case needed)"},
+		{`{"A": null}`, map[string]string{}, nil, "$.A: null value"},
+		{`{"A": ""}`, map[string]string{}, nil, "$.A: empty value"},
+		{`{"A": [1, {"b": 1e999}]}`, map[string]string{}, nil, "$.A[1].b: invalid number '1e999'"},
+		{`{"logs": "x"}`, map[string]string{}, nil, "$.logs: must be an array of strings"},
+		{`{"logs": ["x", 2]}`, map[string]string{}, []string{"x"}, "$.logs[1]: log must be a string"},
+	}
+
+	for _, test := range tests {
+		result := &TaskResult{
+			Host:       &Host{Name: "h"},
+			Values:     make(map[string]string),
+			Structured: make(map[string]interface{}),
+		}
+		result.parseJSONOutput([]byte(test.output))
+
+		switch {
+		case test.err == "" && len(result.Errors) > 0:
+			t.Errorf("%q: errors: %q", test.output, result.Errors)
+		case test.err != "" && len(result.Errors) != 1:
+			t.Errorf("%q: errors: %q, want one containing '%s'", test.output, result.Errors, test.err)
+		case test.err != "" && strings.Contains(result.Errors[0].Error(), test.err) == false:
+			t.Errorf("%q: error is '%s', want '%s'", test.output, result.Errors[0], test.err)
+		}
+		if test.values != nil && reflect.DeepEqual(result.Values, test.values) == false {
+			t.Errorf("%q: values = %q, want %q", test.output, result.Values, test.values)
+		}
+		if reflect.DeepEqual(result.Logs, test.logs) == false {
+			t.Errorf("%q: logs = %q, want %q", test.output, result.Logs, test.logs)
+		}
+	}
+}
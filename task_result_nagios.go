@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Nagios plugin statuses (exit codes)
+const (
+	NagiosOK       = 0
+	NagiosWarning  = 1
+	NagiosCritical = 2
+	NagiosUnknown  = 3
+)
+
+// nagiosStatusNames gives the name of each Nagios status
+var nagiosStatusNames = map[int]string{
+	NagiosOK:       "OK",
+	NagiosWarning:  "WARNING",
+	NagiosCritical: "CRITICAL",
+	NagiosUnknown:  "UNKNOWN",
+}
+
+// Values set by Nagios plugins probes (see parseNagiosOutput)
+const (
+	NagiosStatusValue = "NAGIOS_STATUS"
+	NagiosTextValue   = "NAGIOS_TEXT"
+	NagiosPerfValue   = "PERF"      // PERF[label]
+	NagiosWarnValue   = "PERF_WARN" // PERF_WARN[label], "true" if out of range
+	NagiosCritValue   = "PERF_CRIT"
+	NagiosMinValue    = "PERF_MIN"
+	NagiosMaxValue    = "PERF_MAX"
+)
+
+// nagiosImplicitChecks returns checks added to Nagios plugins probes: the
+// plugin status and perfdata thresholds, with matching classes. They use
+// negative indexes, so user checks can be added or removed without
+// changing their currentFail hashes. A threshold only alerts if its
+// severity is not already given by the plugin status (or, for warning
+// thresholds, by the critical one), so an event gives one alert per
+// severity.
+func nagiosImplicitChecks() ([]*Check, error) {
+	list := []struct {
+		desc      string
+		expr      string
+		class     string
+		textValue string
+	}{
+		{"Nagios WARNING", fmt.Sprintf("%s == %d", NagiosStatusValue, NagiosWarning), WarningClass, NagiosTextValue},
+		{"Nagios CRITICAL", fmt.Sprintf("%s == %d", NagiosStatusValue, NagiosCritical), CriticalClass, NagiosTextValue},
+		{"perfdata warning threshold", fmt.Sprintf("%s == 'true' && %s == 'false' && %s == %d", NagiosWarnValue, NagiosCritValue, NagiosStatusValue, NagiosOK), WarningClass, ""},
+		{"perfdata critical threshold", fmt.Sprintf("%s == 'true' && %s != %d", NagiosCritValue, NagiosStatusValue, NagiosCritical), CriticalClass, ""},
+	}
+
+	var checks []*Check
+	for num, item := range list {
+		expr, err := govaluate.NewEvaluableExpressionWithFunctions(item.expr, CheckFunctions)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, &Check{
+			Index:           -(num + 1),
+			Desc:            item.desc,
+			If:              expr,
+			Type:            ValueAuto,
+			Classes:         []string{item.class},
+			NeededFailures:  1,
+			NeededSuccesses: 1,
+			Implicit:        true,
+			TextValue:       item.textValue,
+		})
+	}
+	return checks, nil
+}
+
+// parseNagiosOutput parses the output of a Nagios plugin: the first line
+// is the text (a log, and the alert text), followed by perfdata after
+// a "|", other lines being the long text (with more perfdata after
+// its first "|", if any). The exit status is the Nagios status.
+func (result *TaskResult) parseNagiosOutput(data []byte, status int) {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	var perfdata []string
+	text, perf, _ := strings.Cut(lines[0], "|")
+	text = strings.TrimSpace(text)
+	perfdata = append(perfdata, perf)
+
+	if text != "" {
+		result.Values[NagiosTextValue] = text
+		result.addLog(text)
+	}
+
+	inPerf := false
+	for _, line := range lines[1:] {
+		if inPerf == false {
+			long, perf, found := strings.Cut(line, "|")
+			if strings.TrimSpace(long) != "" {
+				result.addLog(long)
+			}
+			if found == false {
+				continue
+			}
+			line = perf
+			inPerf = true
+		}
+		perfdata = append(perfdata, line)
+	}
+
+	for _, item := range nagiosPerfItems(strings.Join(perfdata, " ")) {
+		if err := result.addNagiosPerf(item); err != nil {
+			result.addError(fmt.Errorf("perfdata: %s", err))
+		}
+	}
+
+	switch status {
+	case NagiosOK, NagiosWarning, NagiosCritical:
+		result.Values[NagiosStatusValue] = strconv.Itoa(status)
+	case NagiosUnknown:
+		result.addError(fmt.Errorf("Nagios UNKNOWN: %s", text))
+	default:
+		result.addError(fmt.Errorf("plugin exit status %d is not a Nagios status (0 to 3): %s", status, text))
+	}
+}
+
+// nagiosPerfItems splits perfdata in 'label'=value;warn;crit;min;max
+// items (labels may be quoted, with spaces)
+func nagiosPerfItems(perfdata string) []string {
+	var (
+		items   []string
+		current bytes.Buffer
+		quoted  bool
+	)
+	for _, c := range perfdata {
+		switch {
+		case c == '\'':
+			quoted = !quoted // '' (an escaped quote) toggles twice
+			current.WriteRune(c)
+		case (c == ' ' || c == '\t') && quoted == false:
+			if current.Len() > 0 {
+				items = append(items, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if current.Len() > 0 {
+		items = append(items, current.String())
+	}
+	return items
+}
+
+// addNagiosPerf adds a perfdata item as labelled values
+func (result *TaskResult) addNagiosPerf(item string) error {
+	sep := strings.LastIndex(item, "=")
+	if sep < 1 {
+		return fmt.Errorf("invalid item '%s'", item)
+	}
+	label := item[:sep]
+	if len(label) >= 2 && label[0] == '\'' && label[len(label)-1] == '\'' {
+		label = strings.Replace(label[1:len(label)-1], "''", "'", -1)
+	}
+
+	fields := strings.Split(item[sep+1:], ";")
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+
+	if fields[0] == "U" {
+		result.addLog(fmt.Sprintf("perfdata '%s': undetermined value", label))
+		return nil
+	}
+
+	parts := valueNumberRegexp.FindStringSubmatch(fields[0])
+	if parts == nil {
+		return fmt.Errorf("'%s': invalid value '%s'", label, fields[0])
+	}
+	num, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return fmt.Errorf("'%s': invalid value '%s'", label, fields[0])
+	}
+	uom := parts[2]
+
+	values := map[string]string{NagiosPerfValue: nagiosPerfValue(parts[1], uom)}
+	for i, name := range []string{NagiosMinValue, NagiosMaxValue} {
+		if field := fields[i+3]; field != "" {
+			values[name] = nagiosPerfValue(field, uom)
+		}
+	}
+	for i, name := range []string{NagiosWarnValue, NagiosCritValue} {
+		alert, err := nagiosThresholdAlert(fields[i+1], num)
+		if err != nil {
+			return fmt.Errorf("'%s': %s", label, err)
+		}
+		values[name] = strconv.FormatBool(alert)
+	}
+
+	for name, val := range values {
+		if err := result.addLabelledValue(name, label, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nagiosPerfValue returns the value with its unit, if known (see
+// valueUnits, so it's normalized by "number" checks, "c" counters are
+// simple numbers)
+func nagiosPerfValue(val string, uom string) string {
+	if _, known := valueUnits[uom]; known == true {
+		return val + uom
+	}
+	return val
+}
+
+// nagiosThresholdAlert returns true if the value is out of the Nagios
+// threshold range ("10" is 0 to 10, "10:" is 10 to infinity, "~:10" is
+// minus infinity to 10, "10:20" is 10 to 20, and "@10:20" alerts if the
+// value is inside the range). An empty range never alerts.
+func nagiosThresholdAlert(threshold string, value float64) (bool, error) {
+	if threshold == "" {
+		return false, nil
+	}
+
+	inside := strings.HasPrefix(threshold, "@")
+	rng := strings.TrimPrefix(threshold, "@")
+
+	start, end := "0", rng
+	if before, after, found := strings.Cut(rng, ":"); found == true {
+		start, end = before, after
+	}
+	if start == "" {
+		start = "0"
+	}
+
+	low, high := 0.0, 0.0
+	lowSet, highSet := start != "~", end != ""
+	var err error
+	if lowSet == true {
+		if low, err = strconv.ParseFloat(start, 64); err != nil {
+			return false, fmt.Errorf("invalid threshold '%s'", threshold)
+		}
+	}
+	if highSet == true {
+		if high, err = strconv.ParseFloat(end, 64); err != nil {
+			return false, fmt.Errorf("invalid threshold '%s'", threshold)
+		}
+	}
+
+	in := (lowSet == false || value >= low) && (highSet == false || value <= high)
+	if inside == true {
+		return in, nil
+	}
+	return !in, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNagiosThresholdAlert(t *testing.T) {
+	tests := []struct {
+		threshold string
+		value     float64
+		alert     bool
+	}{
+		{"", 100, false},
+
+		// 0 to 10
+		{"10", 0, false},
+		{"10", 10, false},
+		{"10", 11, true},
+		{"10", -1, true},
+
+		// 10 to infinity
+		{"10:", 9, true},
+		{"10:", 10, false},
+		{"10:", 1e9, false},
+
+		// minus infinity to 10
+		{"~:10", -1e9, false},
+		{"~:10", 10, false},
+		{"~:10", 10.5, true},
+
+		// empty start is 0
+		{":10", 5, false},
+		{":10", -1, true},
+
+		// 10 to 20
+		{"10:20", 9.9, true},
+		{"10:20", 10, false},
+		{"10:20", 20, false},
+		{"10:20", 21, true},
+
+		// inside the range (inclusive)
+		{"@10:20", 9, false},
+		{"@10:20", 10, true},
+		{"@10:20", 15, true},
+		{"@10:20", 20, true},
+		{"@10:20", 21, false},
+		{"@10", 5, true},
+		{"@10", 11, false},
+		{"@~:0", -5, true},
+		{"@~:0", 1, false},
+
+		// decimals and negative values
+		{"-5:-1", -3, false},
+		{"-5:-1", 0, true},
+		{"0.5:1.5", 1.6, true},
+	}
+
+	for _, test := range tests {
+		alert, err := nagiosThresholdAlert(test.threshold, test.value)
+		if err != nil {
+			t.Errorf("threshold '%s', value %g: unexpected error: %s", test.threshold, test.value, err)
+			continue
+		}
+		if alert != test.alert {
+			t.Errorf("threshold '%s', value %g: got %t, want %t", test.threshold, test.value, alert, test.alert)
+		}
+	}
+}
+
+func TestNagiosThresholdAlertErrors(t *testing.T) {
+	for _, threshold := range []string{"a", "10:b", "@x", "1:2:3", "~"} {
+		if _, err := nagiosThresholdAlert(threshold, 1); err == nil {
+			t.Errorf("threshold '%s': error expected", threshold)
+		}
+	}
+}
+
+func TestNagiosPerfItems(t *testing.T) {
+	tests := []struct {
+		perfdata string
+		items    []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"a=1", []string{"a=1"}},
+		{"load1=0.5;5;10;0 load5=0.3;4;8;0", []string{"load1=0.5;5;10;0", "load5=0.3;4;8;0"}},
+		{"  a=1\t b=2 ", []string{"a=1", "b=2"}},
+		{"'my disk'=80%;90;95 b=1", []string{"'my disk'=80%;90;95", "b=1"}},
+		{"'it''s here'=5 x=1", []string{"'it''s here'=5", "x=1"}},
+		{"'/var/lib data'=1GB '/'=2GB", []string{"'/var/lib data'=1GB", "'/'=2GB"}},
+	}
+
+	for _, test := range tests {
+		items := nagiosPerfItems(test.perfdata)
+		if !reflect.DeepEqual(items, test.items) {
+			t.Errorf("perfdata '%s': got %q, want %q", test.perfdata, items, test.items)
+		}
+	}
+}
+
+func TestNagiosOutputExit(t *testing.T) {
+	tests := []struct {
+		stdout string
+		text   string
+		logs   []string
+		status int
+	}{
+		{"OK - all good|a=1\n__EXIT=0\n", "OK - all good", []string{"OK - all good"}, 0},
+		{"OK - all good|a=1__EXIT=0\n", "OK - all good", []string{"OK - all good"}, 0},
+		{"WARNING - __EXIT=12 in log|a=1\n__EXIT=1\n", "WARNING - __EXIT=12 in log", []string{"WARNING - __EXIT=12 in log"}, 1},
+		{"OK - x|a=1\n__EXIT=a\n__STATE=b\n__EXIT=0\n", "OK - x", []string{"OK - x", "__EXIT=a", "__STATE=b"}, 0},
+	}
+
+	for _, test := range tests {
+		run, result, status := testReadStdout(t, &Probe{Name: "p", Output: OutputNagios, Labelled: []string{"PERF", "PERF_WARN", "PERF_CRIT", "PERF_MIN", "PERF_MAX"}}, test.stdout)
+		if len(run.Errors) > 0 || len(result.Errors) > 0 {
+			t.Errorf("%q: errors: %q %q", test.stdout, run.Errors, result.Errors)
+		}
+		if status != test.status {
+			t.Errorf("%q: status = %d, want %d", test.stdout, status, test.status)
+		}
+		if text := result.Values[NagiosTextValue]; text != test.text {
+			t.Errorf("%q: text = %q, want %q", test.stdout, text, test.text)
+		}
+		if reflect.DeepEqual(result.Logs, test.logs) == false {
+			t.Errorf("%q: logs = %q, want %q", test.stdout, result.Logs, test.logs)
+		}
+		if result.Values["PERF"] != "" || result.LabelledValues["a"]["PERF"] != "1" {
+			t.Errorf("%q: perfdata = %q", test.stdout, result.LabelledValues)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+// testCheck returns a check with the given 'if' expression
+func testCheck(t *testing.T, index int, expr string) *Check {
+	eval, err := govaluate.NewEvaluableExpressionWithFunctions(expr, CheckFunctions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Check{Index: index, Desc: expr, If: eval, Type: ValueAuto, NeededFailures: 1, NeededSuccesses: 1}
+}
+
+// testLabelledResult returns a result of the probe with the given
+// unlabelled and labelled values
+func testLabelledResult(probe *Probe, values map[string]string, labelled map[string]map[string]string) *TaskResult {
+	result := &TaskResult{
+		Task:           &Task{Probe: probe},
+		Host:           &Host{Name: "h"},
+		Values:         values,
+		LabelledValues: labelled,
+	}
+	for label := range labelled {
+		result.Labels = append(result.Labels, label)
+	}
+	sort.Strings(result.Labels)
+	return result
+}
+
+// checkLabels returns labels of check results ("-" for an unlabelled one)
+func checkLabels(results []*CheckResult) []string {
+	labels := []string{}
+	for _, res := range results {
+		if res.Label == "" {
+			labels = append(labels, "-")
+			continue
+		}
+		labels = append(labels, res.Label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func TestCheckFailHash(t *testing.T) {
+	check := &Check{Index: 1}
+	base := checkFailHash("h", "p", check, "")
+
+	hashes := map[string]string{
+		"base":        base,
+		"label a":     checkFailHash("h", "p", check, "a"),
+		"label b":     checkFailHash("h", "p", check, "b"),
+		"other index": checkFailHash("h", "p", &Check{Index: 2}, ""),
+		"other host":  checkFailHash("h2", "p", check, ""),
+		"other probe": checkFailHash("h", "p2", check, ""),
+	}
+	seen := make(map[string]string)
+	for name, hash := range hashes {
+		if other, exists := seen[hash]; exists == true {
+			t.Errorf("%s and %s have the same hash", name, other)
+		}
+		seen[hash] = name
+	}
+
+	if checkFailHash("h", "p", check, "a") != checkFailHash("h", "p", &Check{Index: 1}, "a") {
+		t.Errorf("instance hash is not stable")
+	}
+	if checkFailHash("h", "p", check, "a") != MD5Hash(base+"[a]") {
+		t.Errorf("instance hash is not based on the check hash")
+	}
+}
+
+func TestDoChecksInstances(t *testing.T) {
+	probe := &Probe{Name: "p", Labelled: []string{"PERC", "FREE", "TEMP"}}
+	perc := testCheck(t, 0, "PERC > 90")
+	both := testCheck(t, 1, "PERC > 90 && FREE < 10")
+	plain := testCheck(t, 2, "LOAD > 2")
+	probe.Checks = []*Check{perc, both, plain}
+
+	result := testLabelledResult(probe, map[string]string{"LOAD": "3"}, map[string]map[string]string{
+		"/":     {"PERC": "95", "FREE": "5"},
+		"/var":  {"PERC": "50", "FREE": "50"},
+		"/home": {"PERC": "91"}, // no FREE: error for both
+		"cpu0":  {"TEMP": "70"}, // another family, ignored
+		"/tmp":  {"PERC": "-1", "FREE": "80"},
+	})
+	result.DoChecks()
+
+	failed := map[*Check][]*CheckResult{}
+	successful := map[*Check][]*CheckResult{}
+	for _, res := range result.FailedChecks {
+		failed[res.Check] = append(failed[res.Check], res)
+	}
+	for _, res := range result.SuccessfulChecks {
+		successful[res.Check] = append(successful[res.Check], res)
+	}
+
+	tests := []struct {
+		check      *Check
+		failed     []string
+		successful []string
+	}{
+		{perc, []string{"/", "/home"}, []string{"/tmp", "/var"}},
+		{both, []string{"/"}, []string{"/tmp", "/var"}},
+		{plain, []string{"-"}, []string{}},
+	}
+	for _, test := range tests {
+		if got := checkLabels(failed[test.check]); reflect.DeepEqual(got, test.failed) == false {
+			t.Errorf("%s: failed = %q, want %q", test.check.Desc, got, test.failed)
+		}
+		if got := checkLabels(successful[test.check]); reflect.DeepEqual(got, test.successful) == false {
+			t.Errorf("%s: successful = %q, want %q", test.check.Desc, got, test.successful)
+		}
+	}
+	if len(result.Errors) != 1 {
+		t.Errorf("errors = %q, want 1 (FREE[/home])", result.Errors)
+	}
+}
+
+func TestGoneInstances(t *testing.T) {
+	testAlertsSetup(t)
+
+	check := testCheck(t, 0, "PERC > 90")
+	base := checkFailHash("h", "p", check, "")
+	for _, label := range []string{"/", "/gone"} {
+		CurrentFailAdd(checkFailHash("h", "p", check, label), &CurrentFail{Label: label, CheckHash: base})
+	}
+	CurrentFailAdd(base, &CurrentFail{CheckHash: base})
+
+	// evaluated per instance: unreported instances and the unlabelled
+	// fail are gone
+	labelled := &Probe{Name: "p", Labelled: []string{"PERC"}, Checks: []*Check{check}}
+	result := testLabelledResult(labelled, map[string]string{}, map[string]map[string]string{"/": {"PERC": "95"}})
+	result.DoChecks()
+	if got, want := checkLabels(result.goneInstances("h", check)), []string{"-", "/gone"}; reflect.DeepEqual(got, want) == false {
+		t.Errorf("labelled: gone = %q, want %q", got, want)
+	}
+
+	// no instance reported at all
+	result = testLabelledResult(labelled, map[string]string{}, map[string]map[string]string{})
+	result.DoChecks()
+	if got, want := checkLabels(result.goneInstances("h", check)), []string{"-", "/", "/gone"}; reflect.DeepEqual(got, want) == false {
+		t.Errorf("no instance: gone = %q, want %q", got, want)
+	}
+
+	// no longer labelled: every instance is gone, not the check itself,
+	// even if the script prints a labelled value
+	unlabelled := &Probe{Name: "p", Checks: []*Check{check}}
+	result = testLabelledResult(unlabelled, map[string]string{"PERC": "95"}, map[string]map[string]string{"/": {"PERC": "95"}})
+	result.DoChecks()
+	if got, want := checkLabels(result.goneInstances("h", check)), []string{"/", "/gone"}; reflect.DeepEqual(got, want) == false {
+		t.Errorf("unlabelled: gone = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// TaskSchedule holds the saved schedule of a Task (see Task PrevRun
+// and NextRun)
+type TaskSchedule struct {
+	Host    string
+	Probe   string
+	PrevRun time.Time
+	NextRun time.Time
+}
+
+var (
+	taskSchedules      = make(map[string]*TaskSchedule)
+	taskSchedulesMutex sync.Mutex
+)
+
+const schedulesFile string = "nosee-schedules.json"
+
+func taskScheduleHash(host *Host, task *Task) string {
+	return MD5Hash(host.Name + task.Probe.Name)
+}
+
+// taskSchedulesWrite dumps task schedules to disk (the mutex must be
+// held by the caller)
+func taskSchedulesWrite() {
+	path := path.Clean(GlobalConfigGet().SavePath + "/" + schedulesFile)
+	if err := SaveJSONFile(path, &taskSchedules); err != nil {
+		Error.Printf("can't save schedules: %s (see save_path param?)", err)
+		return
+	}
+	Trace.Printf("task schedules successfully saved to '%s'", path)
+}
+
+// TaskSchedulesUpdate records schedules of host's tasks and save
+// them to disk. It must be called by the host Schedule goroutine.
+func TaskSchedulesUpdate(host *Host) {
+	taskSchedulesMutex.Lock()
+	for _, task := range host.Tasks {
+		taskSchedules[taskScheduleHash(host, task)] = &TaskSchedule{
+			Host:    host.Name,
+			Probe:   task.Probe.Name,
+			PrevRun: task.PrevRun,
+			NextRun: task.NextRun,
+		}
+	}
+	taskSchedulesMutex.Unlock()
+
+	// see CurrentFailsSave
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		taskSchedulesMutex.Lock()
+		defer taskSchedulesMutex.Unlock()
+		taskSchedulesWrite()
+	}()
+}
+
+// TaskSchedulesForget deletes saved schedules of the named host
+func TaskSchedulesForget(hostName string) {
+	taskSchedulesMutex.Lock()
+	defer taskSchedulesMutex.Unlock()
+	for hash, ts := range taskSchedules {
+		if ts.Host == hostName {
+			delete(taskSchedules, hash)
+		}
+	}
+}
+
+// TaskSchedulesFlush synchronously dumps task schedules to disk
+func TaskSchedulesFlush() {
+	taskSchedulesMutex.Lock()
+	defer taskSchedulesMutex.Unlock()
+	taskSchedulesWrite()
+}
+
+// TaskSchedulesLoad will load from disk previous task schedules and
+// restore them in hosts tasks. A restored NextRun can't be later than
+// the one computed from PrevRun and the current probe delay or schedule.
+func TaskSchedulesLoad(hosts []*Host) {
+	taskSchedulesMutex.Lock()
+	defer taskSchedulesMutex.Unlock()
+
+	path := path.Clean(GlobalConfigGet().SavePath + "/" + schedulesFile)
+	f, err := os.Open(path)
+	if err != nil {
+		Warning.Printf("can't read previous schedules: %s, no schedule loaded", err)
+		return
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&taskSchedules)
+	if err != nil {
+		Error.Printf("'%s' json decode: %s", path, err)
+		return
+	}
+
+	// only keep schedules of current tasks
+	saved := taskSchedules
+	taskSchedules = make(map[string]*TaskSchedule)
+
+	restored := 0
+	for _, host := range hosts {
+		for _, task := range host.Tasks {
+			hash := taskScheduleHash(host, task)
+			ts, exists := saved[hash]
+			if exists == false {
+				continue
+			}
+			taskSchedules[hash] = ts
+			task.PrevRun = ts.PrevRun
+			task.NextRun = ts.NextRun
+			if max := task.Probe.NextRunAfter(ts.PrevRun); task.NextRun.After(max) {
+				task.NextRun = max
+			}
+			restored++
+		}
+	}
+	Info.Printf("'%s' loaded: %d task schedule(s) restored", path, restored)
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -22,6 +25,59 @@ func IsAllUpper(str string) bool {
 	return str == strings.ToUpper(str)
 }
 
+// StringInSlice returns true if str is in the list
+func StringInSlice(str string, list []string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// FindLoop returns a loop of the graph, given as a map of node names to
+// the names they point to, as a path ("a", "b", "a"), or nil if there's
+// none. Every target must be a node of the graph.
+func FindLoop(graph map[string][]string) []string {
+	names := make([]string, 0, len(graph))
+	for name := range graph {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// depth-first search, 1 = visiting, 2 = done
+	state := make(map[string]int)
+	var visit func(name string, path []string) []string
+	visit = func(name string, path []string) []string {
+		switch state[name] {
+		case 1:
+			// the path may start before the loop
+			for i, step := range path {
+				if step == name {
+					return append(path[i:], name)
+				}
+			}
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		path = append(path, name)
+		for _, target := range graph[name] {
+			if loop := visit(target, path); loop != nil {
+				return loop
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, name := range names {
+		if loop := visit(name, nil); loop != nil {
+			return loop
+		}
+	}
+	return nil
+}
+
 // MD5Hash will hash input text and return MD5 sum
 func MD5Hash(text string) string {
 	hasher := md5.New()
@@ -82,3 +138,40 @@ func StringExpandVariables(str string, variables map[string]interface{}) string
 	}
 	return str
 }
+
+// SaveJSONFile encodes v as JSON in the given file, replacing
+// the previous one atomically (see SaveFile)
+func SaveJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return SaveFile(path, append(data, '\n'))
+}
+
+// SaveFile writes data in the given file, replacing the previous
+// one atomically (thru a temporary file and a rename)
+func SaveFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("creating '%s': %s", tmpPath, err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("writing '%s': %s", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("renaming '%s': %s", tmpPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindLoop(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph map[string][]string
+		want  []string
+	}{
+		{"empty", map[string][]string{}, nil},
+		{"no edges", map[string][]string{"a": nil, "b": {}}, nil},
+		{"chain", map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil}, nil},
+		{"diamond", map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil}, nil},
+		{"self", map[string][]string{"a": {"a"}}, []string{"a", "a"}},
+		{"two nodes", map[string][]string{"a": {"b"}, "b": {"a"}}, []string{"a", "b", "a"}},
+		{"three nodes", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, []string{"a", "b", "c", "a"}},
+		// the path to the loop is not part of it
+		{"loop after a path", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"d"}, "d": {"b"}}, []string{"b", "c", "d", "b"}},
+		{"loop after a done branch", map[string][]string{"a": {"b", "c"}, "b": nil, "c": {"a"}}, []string{"a", "c", "a"}},
+	}
+
+	for _, test := range tests {
+		if got := FindLoop(test.graph); reflect.DeepEqual(got, test.want) == false {
+			t.Errorf("%s: loop is %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckHostsParents(t *testing.T) {
+	tests := []struct {
+		parents map[string][]string
+		err     string
+	}{
+		{map[string][]string{"web": {"gw"}, "db": {"gw"}, "gw": {"router"}, "router": nil}, ""},
+		{map[string][]string{"web": {"gw"}}, "host 'web' has an unknown parent 'gw'"},
+		{map[string][]string{"gw": {"gw"}}, "parent loop detected (gw -> gw)"},
+		{map[string][]string{"web": {"gw"}, "gw": {"vpn"}, "vpn": {"gw"}}, "parent loop detected (gw -> vpn -> gw)"},
+	}
+
+	for num, test := range tests {
+		var hosts []*Host
+		for name, parents := range test.parents {
+			hosts = append(hosts, &Host{Name: name, Parents: parents})
+		}
+		testConfigError(t, num, checkHostsParents(hosts), test.err)
+	}
+}
+
+func TestCheckProbesDependencies(t *testing.T) {
+	tests := []struct {
+		dependsOn map[string][]string
+		err       string
+	}{
+		{map[string][]string{"http": {"ping", "dns"}, "dns": {"ping"}, "ping": nil}, ""},
+		{map[string][]string{"http": {"ping"}}, "probe 'http' depends on an unknown probe 'ping'"},
+		{map[string][]string{"http": {"http"}}, "probe dependency loop detected (http -> http)"},
+		{map[string][]string{"ping": nil, "http": {"tls"}, "tls": {"ping", "http"}}, "probe dependency loop detected (http -> tls -> http)"},
+	}
+
+	for num, test := range tests {
+		var probes []*Probe
+		for name, dependsOn := range test.dependsOn {
+			probes = append(probes, &Probe{Name: name, DependsOn: dependsOn})
+		}
+		testConfigError(t, num, checkProbesDependencies(probes), test.err)
+	}
+}
+
+// testConfigError checks that err is nil if want is empty, or contains it
+func testConfigError(t *testing.T, num int, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("#%d: unexpected error: %s", num, err)
+	case want != "" && err == nil:
+		t.Errorf("#%d: no error, want '%s'", num, want)
+	case want != "" && strings.Contains(err.Error(), want) == false:
+		t.Errorf("#%d: error is '%s', want '%s'", num, err, want)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Transport is the way a Run reaches its host: Connect prepares a new
+// session, then the bootstrap shell is started with Run, using stdin,
+// stdout and stderr pipes (requested before Run)
+type Transport interface {
+	Connect() error
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	StderrPipe() (io.Reader, error)
+	Run(cmd string) error
+	// Close ends the session (a persistent connection is kept)
+	Close() error
+	// Disconnect ends the session and the connection
+	Disconnect() error
+}
+
+// Transport types
+const (
+	TransportSSH   = "ssh"
+	TransportLocal = "local"
+	TransportExec  = "exec"
+)
+
+// CommandTransport runs the bootstrap shell with a local command:
+// directly on the Nosee machine ("local" transport, no Command), or
+// appended to a configured command ("exec" transport, ex: the system
+// ssh client, so ~/.ssh/config is used)
+type CommandTransport struct {
+	Command []string
+
+	mutex   sync.Mutex
+	cmd     *exec.Cmd
+	pid     int        // running command (0 if none)
+	child   []*os.File // child side of the pipes, closed once started
+	stdin   *os.File
+	outputs []*os.File // our side of stdout and stderr pipes
+}
+
+// Connect prepares a new session (the command is started by Run)
+func (transport *CommandTransport) Connect() error {
+	if len(transport.Command) > 0 {
+		if _, err := exec.LookPath(transport.Command[0]); err != nil {
+			return fmt.Errorf("exec transport: %s", err)
+		}
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.closeFiles()
+	transport.cmd = &exec.Cmd{}
+	return nil
+}
+
+// pipe creates a pipe, the child side (read side for stdin, write side
+// for outputs) being kept for Run
+func (transport *CommandTransport) pipe(input bool) (*os.File, error) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	if transport.cmd == nil {
+		return nil, errors.New("not connected")
+	}
+	if transport.cmd.Process != nil {
+		return nil, errors.New("pipe requested after Run")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	if input == true {
+		transport.child = append(transport.child, r)
+		transport.stdin = w
+		transport.cmd.Stdin = r
+		return w, nil
+	}
+	transport.child = append(transport.child, w)
+	transport.outputs = append(transport.outputs, r)
+	return r, nil
+}
+
+// closedOutput is the reader side of an output pipe, where a pipe closed
+// by Disconnect is a normal end of stream (as with SSH)
+type closedOutput struct {
+	*os.File
+}
+
+func (output closedOutput) Read(b []byte) (int, error) {
+	n, err := output.File.Read(b)
+	if errors.Is(err, os.ErrClosed) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// StdinPipe returns a pipe connected to the command standard input
+func (transport *CommandTransport) StdinPipe() (io.WriteCloser, error) {
+	return transport.pipe(true)
+}
+
+// StdoutPipe returns a pipe connected to the command standard output
+func (transport *CommandTransport) StdoutPipe() (io.Reader, error) {
+	file, err := transport.pipe(false)
+	if err != nil {
+		return nil, err
+	}
+	transport.mutex.Lock()
+	transport.cmd.Stdout = transport.child[len(transport.child)-1]
+	transport.mutex.Unlock()
+	return closedOutput{file}, nil
+}
+
+// StderrPipe returns a pipe connected to the command standard error
+func (transport *CommandTransport) StderrPipe() (io.Reader, error) {
+	file, err := transport.pipe(false)
+	if err != nil {
+		return nil, err
+	}
+	transport.mutex.Lock()
+	transport.cmd.Stderr = transport.child[len(transport.child)-1]
+	transport.mutex.Unlock()
+	return closedOutput{file}, nil
+}
+
+// Run starts cmd (appended to the transport command, if any) and waits
+// for its end
+func (transport *CommandTransport) Run(cmd string) error {
+	args := append(append([]string{}, transport.Command...), strings.Fields(cmd)...)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	transport.mutex.Lock()
+	command := transport.cmd
+	if command == nil {
+		transport.mutex.Unlock()
+		return errors.New("not connected")
+	}
+	command.Path = path
+	command.Args = args
+	setProcessGroup(command)
+	err = command.Start()
+	if err == nil {
+		transport.pid = command.Process.Pid
+	}
+	for _, file := range transport.child {
+		file.Close()
+	}
+	transport.child = nil
+	transport.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	Trace.Printf("command transport started: %s (pid %d)", strings.Join(args, " "), command.Process.Pid)
+
+	return transport.wait(command)
+}
+
+// Close ends the session: the command (and any remaining child, where
+// supported) is killed, if still running, and its standard input closed.
+// Outputs are left open, so everything can still be read (they're
+// closed by the next Connect or by Disconnect).
+func (transport *CommandTransport) Close() error {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	var err error
+	if transport.pid != 0 {
+		err = transport.kill()
+		transport.pid = 0
+	}
+	if transport.stdin != nil {
+		transport.stdin.Close()
+		transport.stdin = nil
+	}
+	transport.cmd = nil
+	return err
+}
+
+// Disconnect ends the session and closes outputs, unblocking any reader
+func (transport *CommandTransport) Disconnect() error {
+	err := transport.Close()
+
+	transport.mutex.Lock()
+	transport.closeFiles()
+	transport.mutex.Unlock()
+	return err
+}
+
+func (transport *CommandTransport) closeFiles() {
+	for _, file := range append(transport.child, transport.outputs...) {
+		file.Close()
+	}
+	transport.child = nil
+	transport.outputs = nil
+}
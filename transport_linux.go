@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// setProcessGroup gives the command its own process group, so it can be
+// killed with its children (except task scripts, they have their own
+// group and watchdog)
+func setProcessGroup(command *exec.Cmd) {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// wait for the end of the command: remaining children are killed while
+// the exited command is not reaped yet, since its process group ID
+// can't be reused until then
+func (transport *CommandTransport) wait(command *exec.Cmd) error {
+	if err := waitExited(command.Process.Pid); err != nil {
+		Warning.Printf("command transport: can't wait for pid %d: %s", command.Process.Pid, err)
+	}
+	transport.mutex.Lock()
+	if transport.pid != 0 {
+		if err := transport.kill(); err != nil {
+			Warning.Printf("command transport: can't kill process group %d: %s", transport.pid, err)
+		}
+		transport.pid = 0
+	}
+	transport.mutex.Unlock()
+	return command.Wait()
+}
+
+// kill the process group of the running command (mutex must be held)
+func (transport *CommandTransport) kill() error {
+	err := syscall.Kill(-transport.pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil // already gone
+	}
+	return err
+}
+
+// waitExited blocks until the process has exited, without reaping it
+// (waitid with WNOWAIT)
+func waitExited(pid int) error {
+	const pPID = 1     // P_PID idtype
+	var info [128]byte // siginfo_t
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid), uintptr(unsafe.Pointer(&info[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing here: only the command itself is killed,
+// not its children
+func setProcessGroup(command *exec.Cmd) {
+}
+
+// wait for the end of the command
+func (transport *CommandTransport) wait(command *exec.Cmd) error {
+	err := command.Wait()
+	transport.mutex.Lock()
+	transport.pid = 0
+	transport.mutex.Unlock()
+	return err
+}
+
+// kill the running command (mutex must be held)
+func (transport *CommandTransport) kill() error {
+	err := transport.cmd.Process.Kill()
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil // already gone
+	}
+	return err
+}
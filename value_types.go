@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types of script values, as expected by a check (see Check.Type)
+const (
+	ValueAuto   = "auto" // plain numbers are detected, strings otherwise
+	ValueNumber = "number"
+	ValueBool   = "bool"
+	ValueString = "string"
+)
+
+// signed ints and floats, with optional exponent ("-3", "+0.5", ".5", "1e6")
+// and an optional unit suffix (only allowed for "number" checks)
+var valueNumberRegexp = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)\s*([A-Za-zµ%]*)$`)
+
+// valueUnits gives the factor of each unit suffix: sizes are normalized
+// in bytes (1024 based, as with df or free) and durations in seconds
+var valueUnits = map[string]float64{
+	"%": 1,
+
+	"B": 1,
+	"k": 1 << 10, "K": 1 << 10, "KB": 1 << 10, "KiB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MiB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GiB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TiB": 1 << 40,
+	"P": 1 << 50, "PB": 1 << 50, "PiB": 1 << 50,
+
+	"ns": 1e-9,
+	"us": 1e-6, "µs": 1e-6,
+	"ms":  1e-3,
+	"s":   1,
+	"min": 60,
+	"h":   3600,
+	"d":   86400,
+}
+
+// ParseValue converts a script value that is a plain number to an int64
+// (or a float64, with decimals or an exponent) or leaves it as a string,
+// and returns its type. Units and booleans are left as strings (see
+// TypedValue).
+func ParseValue(val string) (interface{}, string) {
+	if num, ok := parseNumber(val, false); ok == true {
+		return num, ValueNumber
+	}
+	return val, ValueString
+}
+
+// parseNumber converts val to an int64 or a float64, with an optional
+// unit suffix (see valueUnits) if units is true
+func parseNumber(val string, units bool) (interface{}, bool) {
+	parts := valueNumberRegexp.FindStringSubmatch(strings.TrimSpace(val))
+	if parts == nil {
+		return nil, false
+	}
+
+	if parts[2] == "" {
+		if num, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			return num, true
+		}
+	}
+
+	factor := 1.0
+	if parts[2] != "" {
+		var known bool
+		if factor, known = valueUnits[parts[2]]; units == false || known == false {
+			return nil, false
+		}
+	}
+
+	num, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		// out of range, mostly
+		return nil, false
+	}
+	return num * factor, true
+}
+
+// TypedValue returns the script value converted to the wanted type: see
+// ParseValue for "auto", numbers can have a unit suffix (see valueUnits)
+// and booleans are "true" or "false". An error is returned if the value
+// can't be converted.
+func TypedValue(val string, wanted string) (interface{}, error) {
+	switch wanted {
+	case ValueString:
+		return val, nil
+	case ValueNumber:
+		if num, ok := parseNumber(val, true); ok == true {
+			return num, nil
+		}
+	case ValueBool:
+		switch strings.TrimSpace(val) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	default:
+		typed, _ := ParseValue(val)
+		return typed, nil
+	}
+	return nil, fmt.Errorf("'%s' is not a %s", val, wanted)
+}
+
+// IsValidValueType returns true if the type is known (see ValueAuto, …)
+func IsValidValueType(valType string) bool {
+	switch valType {
+	case ValueAuto, ValueNumber, ValueBool, ValueString:
+		return true
+	}
+	return false
+}
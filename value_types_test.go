@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		val     string
+		typed   interface{}
+		valType string
+	}{
+		{"0", int64(0), ValueNumber},
+		{"42", int64(42), ValueNumber},
+		{"-3", int64(-3), ValueNumber},
+		{"+7", int64(7), ValueNumber},
+		{"9007199254740993", int64(9007199254740993), ValueNumber},
+		{"0.5", 0.5, ValueNumber},
+		{"+0.5", 0.5, ValueNumber},
+		{".5", 0.5, ValueNumber},
+		{"-2.", -2.0, ValueNumber},
+		{"1e6", 1e6, ValueNumber},
+		{"-1.5E-3", -1.5e-3, ValueNumber},
+		{"99999999999999999999", 1e20, ValueNumber},
+
+		// units and booleans are strings, unless a check asks otherwise
+		{"12G", "12G", ValueString},
+		{"5d", "5d", ValueString},
+		{"2m", "2m", ValueString},
+		{"85%", "85%", ValueString},
+		{"true", "true", ValueString},
+		{"false", "false", ValueString},
+
+		{"", "", ValueString},
+		{"abc", "abc", ValueString},
+		{"1.2.3", "1.2.3", ValueString},
+		{"-", "-", ValueString},
+		{"e6", "e6", ValueString},
+		{"0x10", "0x10", ValueString},
+		{"1e999", "1e999", ValueString},
+	}
+
+	for _, test := range tests {
+		typed, valType := ParseValue(test.val)
+		if reflect.DeepEqual(typed, test.typed) == false || valType != test.valType {
+			t.Errorf("ParseValue(%q) = %#v (%s), want %#v (%s)", test.val, typed, valType, test.typed, test.valType)
+		}
+	}
+}
+
+func TestTypedValue(t *testing.T) {
+	tests := []struct {
+		val    string
+		wanted string
+		typed  interface{} // nil for an error
+	}{
+		{"12", ValueAuto, int64(12)},
+		{"12G", ValueAuto, "12G"},
+		{"true", ValueAuto, "true"},
+
+		{"12", ValueNumber, int64(12)},
+		{"-0.5", ValueNumber, -0.5},
+		{"12G", ValueNumber, 12.0 * (1 << 30)},
+		{"1.5 KiB", ValueNumber, 1536.0},
+		{"300ms", ValueNumber, 0.3},
+		{"5min", ValueNumber, 300.0},
+		{"2h", ValueNumber, 7200.0},
+		{"1d", ValueNumber, 86400.0},
+		{"85%", ValueNumber, 85.0},
+		{"2m", ValueNumber, nil},
+		{"12 apples", ValueNumber, nil},
+		{"true", ValueNumber, nil},
+		{"", ValueNumber, nil},
+
+		{"true", ValueBool, true},
+		{"false", ValueBool, false},
+		{"1", ValueBool, nil},
+		{"TRUE", ValueBool, nil},
+
+		{"12G", ValueString, "12G"},
+		{" x ", ValueString, " x "},
+	}
+
+	for _, test := range tests {
+		typed, err := TypedValue(test.val, test.wanted)
+		if test.typed == nil {
+			if err == nil {
+				t.Errorf("TypedValue(%q, %s): error expected, got %#v", test.val, test.wanted, typed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TypedValue(%q, %s): unexpected error: %s", test.val, test.wanted, err)
+			continue
+		}
+		if reflect.DeepEqual(typed, test.typed) == false {
+			t.Errorf("TypedValue(%q, %s) = %#v, want %#v", test.val, test.wanted, typed, test.typed)
+		}
+	}
+}